@@ -0,0 +1,121 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+const wasmtimePath = "github.com/bytecodealliance/wasmtime-go/v11"
+
+// ModuleCache stores compiled modules on disk, so that large modules don't need to be recompiled every time.
+// Entries are keyed by the module's contents, the engine's configuration, and the wasmtime-go version,
+// so upgrading wasmtime-go invalidates them.
+//
+// Entries are native code that is loaded without verification,
+// so the cache directory must only be writable by trusted users.
+// Loaded entries are memory-mapped: replace files instead of modifying them in place.
+type ModuleCache struct {
+	// Dir is the directory holding the cache, created with permissions 0700 if it doesn't exist.
+	// If empty, a hammertime directory in os.UserCacheDir is used.
+	Dir string
+}
+
+// Compile returns the compiled module for wasm, loading it from the cache if possible,
+// or compiling and saving it otherwise.
+// Failing to save the compiled module isn't an error.
+// Preview2 components are rejected with ErrComponent.
+//
+// Engines can't be inspected, so config must describe the engine's configuration
+// (for example, "epoch" for an engine with epoch interruption).
+// Engines configured differently should use different config strings.
+// wasmtime also refuses to load modules compiled for incompatible engines;
+// those entries are recompiled and replaced.
+func (c *ModuleCache) Compile(engine *wasmtime.Engine, config string, wasm []byte) (*wasmtime.Module, error) {
+	if isComponent(wasm) {
+		return nil, ErrComponent
+	}
+	dir, err := c.dir()
+	if err != nil {
+		return wasmtime.NewModule(engine, wasm)
+	}
+	path := filepath.Join(dir, cacheKey(config, wasm)+".cwasm")
+	if module, err := wasmtime.NewModuleDeserializeFile(engine, path); err == nil {
+		return module, nil
+	}
+
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := module.Serialize(); err == nil {
+		writeCache(dir, path, data)
+	}
+	return module, nil
+}
+
+func (c *ModuleCache) dir() (string, error) {
+	dir := c.Dir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cache, "hammertime")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// cacheKey hashes the wasmtime-go version, engine configuration, and module.
+func cacheKey(config string, wasm []byte) string {
+	h := sha256.New()
+	h.Write([]byte(wasmtimeVersion()))
+	h.Write([]byte{0})
+	h.Write([]byte(config))
+	h.Write([]byte{0})
+	h.Write(wasm)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func wasmtimeVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == wasmtimePath {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			return dep.Path + "@" + dep.Version + dep.Sum
+		}
+	}
+	return "unknown"
+}
+
+// writeCache atomically writes a cache entry, so concurrent readers never see partial files.
+func writeCache(dir, path string, data []byte) {
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,91 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+func TestModuleCache(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "_start")))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache := &ModuleCache{Dir: dir}
+	engine := wasmtime.NewEngine()
+
+	entries := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(dir, "*.cwasm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	if _, err := cache.Compile(engine, "", wasm); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Error("cache dir should be private:", err)
+	}
+	files := entries()
+	if len(files) != 1 {
+		t.Fatal("want 1 cache entry, got:", files)
+	}
+	if module, err := cache.Compile(engine, "", wasm); err != nil || module.Exports()[0].Name() != "_start" {
+		t.Fatal("cached module:", err)
+	}
+
+	// corrupt entries are recompiled
+	// (replaced rather than overwritten, as the cached module maps the file)
+	writeCache(dir, files[0], []byte("garbage"))
+	if _, err := cache.Compile(engine, "", wasm); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(files[0]); err != nil || string(data) == "garbage" {
+		t.Error("corrupt entry not replaced:", err)
+	}
+
+	if _, err := cache.Compile(engine, "other", wasm); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(); len(got) != 2 {
+		t.Error("want separate entry per config, got:", got)
+	}
+
+	cmd := Command(wasm, "prog")
+	cmd.Cache = cache
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+	}
+	if got := entries(); len(got) != 3 {
+		t.Error("want entry for Command, got:", got)
+	}
+
+	// user engines are only cached with a config to key them by
+	cmd = Command(wasm, "prog")
+	cmd.Engine = wasmtime.NewEngine()
+	cmd.Cache = cache
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+	}
+	if got := entries(); len(got) != 3 {
+		t.Error("want no entry for unknown engine, got:", got)
+	}
+	cmd = Command(wasm, "prog")
+	cmd.Engine = wasmtime.NewEngine()
+	cmd.EngineConfig = "default"
+	cmd.Cache = cache
+	if err := cmd.Run(); err != nil {
+		t.Error(err)
+	}
+	if got := entries(); len(got) != 4 {
+		t.Error("want entry for configured engine, got:", got)
+	}
+}
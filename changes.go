@@ -0,0 +1,238 @@
+package hammertime
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ChangeOp is the kind of change made to a path in the guest filesystem.
+type ChangeOp int
+
+const (
+	// ChangeCreate means the path did not exist before the run.
+	ChangeCreate ChangeOp = iota + 1
+	// ChangeModify means the path existed before and was (possibly) written to.
+	ChangeModify
+	// ChangeDelete means the path existed before and was removed.
+	ChangeDelete
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeCreate:
+		return "create"
+	case ChangeModify:
+		return "modify"
+	case ChangeDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Change is a single entry in a Changeset.
+type Change struct {
+	// Path is the absolute guest path, such as "/out/a.txt".
+	Path string
+	Op   ChangeOp
+	Mode fs.FileMode
+	// Data holds the new contents of created or modified regular files.
+	Data []byte
+}
+
+// Changeset is a list of changes made by the guest, sorted by path.
+type Changeset []Change
+
+// Changes reports what the guest created, modified, or deleted in its filesystem so far.
+// Files are marked as modified when they are opened for writing, even if nothing was written.
+// Virtual files and devices aren't part of the filesystem's contents, so they're left out,
+// and reading the changes never calls VirtualFile.Read or reads from a device.
+func (wasi *Instance) Changes() (Changeset, error) {
+	return wasi.filesystem.changeset()
+}
+
+// WriteTar writes the created and modified files of the changeset as a tar stream.
+// Deleted paths are written as empty whiteout files (".wh.<name>"), as in OCI image layers.
+func (cs Changeset) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, c := range cs {
+		name := strings.TrimPrefix(c.Path, "/")
+		hdr := &tar.Header{
+			Name: name,
+			Mode: int64(c.Mode.Perm()),
+		}
+		switch {
+		case c.Op == ChangeDelete:
+			dir, base := path.Split(name)
+			hdr.Name = dir + ".wh." + base
+			hdr.Typeflag = tar.TypeReg
+			hdr.Mode = 0644
+		case c.Mode.IsDir():
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(c.Data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write(c.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// changelog tracks guest paths (relative to the filesystem root) that have been touched.
+type changelog map[string]ChangeOp
+
+func (cl changelog) create(name string) {
+	switch cl[name] {
+	case ChangeDelete:
+		// deleted then recreated
+		cl[name] = ChangeModify
+	case ChangeCreate, ChangeModify:
+	default:
+		cl[name] = ChangeCreate
+	}
+}
+
+func (cl changelog) modify(name string) {
+	if _, ok := cl[name]; !ok {
+		cl[name] = ChangeModify
+	}
+}
+
+func (cl changelog) delete(name string) {
+	// anything underneath is gone too
+	prefix := name + "/"
+	for k, op := range cl {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if op == ChangeCreate {
+			delete(cl, k)
+		} else {
+			cl[k] = ChangeDelete
+		}
+	}
+	switch cl[name] {
+	case ChangeCreate:
+		delete(cl, name)
+	default:
+		cl[name] = ChangeDelete
+	}
+}
+
+// rename records old moving to new. replaced is whether new already existed, and was overwritten.
+func (cl changelog) rename(old, new string, replaced bool) {
+	if replaced {
+		cl.delete(new)
+	}
+	// whatever was touched under old is new under new
+	prefix := old + "/"
+	var moved []string
+	for k, op := range cl {
+		if !strings.HasPrefix(k, prefix) || op == ChangeDelete {
+			continue
+		}
+		delete(cl, k)
+		moved = append(moved, new+"/"+k[len(prefix):])
+	}
+	cl.delete(old)
+	cl.create(new)
+	for _, k := range moved {
+		cl.create(k)
+	}
+}
+
+// changeset builds a Changeset from the current state of the filesystem.
+// Created directories are walked so that everything beneath them is included.
+func (fsys *filesystem) changeset() (Changeset, error) {
+	if fsys.fs == nil {
+		return nil, nil
+	}
+	seen := make(map[string]struct{})
+	var cs Changeset
+	add := func(name string, op ChangeOp) error {
+		if _, ok := seen[name]; ok {
+			return nil
+		}
+		seen[name] = struct{}{}
+		switch fsys.backing(name).(type) {
+		case VirtualFS, *devfs:
+			return nil
+		}
+		c := Change{
+			Path: "/" + name,
+			Op:   op,
+		}
+		if op == ChangeDelete {
+			cs = append(cs, c)
+			return nil
+		}
+		info, err := hackpadfs.Stat(fsys.fs, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.Mode = info.Mode()
+		if info.Mode().IsRegular() {
+			c.Data, err = hackpadfs.ReadFile(fsys.fs, name)
+			if err != nil {
+				return err
+			}
+		}
+		cs = append(cs, c)
+		return nil
+	}
+
+	fsys.mu.Lock()
+	changes := maps.Clone(fsys.changes)
+	fsys.mu.Unlock()
+
+	names := maps.Keys(changes)
+	slices.Sort(names)
+	for _, name := range names {
+		op := changes[name]
+		if err := add(name, op); err != nil {
+			return nil, err
+		}
+		if op != ChangeCreate {
+			continue
+		}
+		err := fs.WalkDir(fsys.fs, name, func(sub string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if sub == name {
+				return nil
+			}
+			subop := ChangeCreate
+			if prev, ok := changes[sub]; ok {
+				subop = prev
+			}
+			return add(sub, subop)
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(cs, func(a, b Change) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return cs, nil
+}
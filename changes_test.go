@@ -0,0 +1,172 @@
+package hammertime
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestChanges(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "old.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "keep.txt", []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "gone.txt", []byte("gone"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src.txt", "dst.txt"} {
+		if err := hackpadfs.WriteFullFile(memfs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := memfs.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "dir/f.txt", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wasi := NewWASI(WithFS(memfs))
+	if errno := wasi.mkdir(rootFD, "/out"); errno != 0 {
+		t.Fatal("mkdir", errno)
+	}
+	fd, errno := wasi.open(rootFD, "/out/a.txt", 0, libc.OflagCreat, 0, libc.RightFdWrite)
+	if errno != 0 {
+		t.Fatal("open", errno)
+	}
+	f, _ := wasi.get(fd)
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	wasi.close(fd)
+	if errno := wasi.rename(rootFD, "/old.txt", "/new.txt"); errno != 0 {
+		t.Fatal("rename", errno)
+	}
+	if errno := wasi.remove(rootFD, "/gone.txt"); errno != 0 {
+		t.Fatal("remove", errno)
+	}
+	// replacing a file modifies it
+	if errno := wasi.rename(rootFD, "/src.txt", "/dst.txt"); errno != 0 {
+		t.Fatal("rename", errno)
+	}
+	// a modified file in a renamed directory is new
+	fd, errno = wasi.open(rootFD, "/dir/f.txt", 0, libc.OflagTrunc, 0, libc.RightFdWrite)
+	if errno != 0 {
+		t.Fatal("open", errno)
+	}
+	f, _ = wasi.get(fd)
+	if _, err := f.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	wasi.close(fd)
+	if errno := wasi.rename(rootFD, "/dir", "/moved"); errno != 0 {
+		t.Fatal("rename", errno)
+	}
+
+	cs, err := wasi.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		path string
+		op   ChangeOp
+		data string
+	}{
+		{"/dir", ChangeDelete, ""},
+		{"/dst.txt", ChangeModify, "src.txt"},
+		{"/gone.txt", ChangeDelete, ""},
+		{"/moved", ChangeCreate, ""},
+		{"/moved/f.txt", ChangeCreate, "changed"},
+		{"/new.txt", ChangeCreate, "old"},
+		{"/old.txt", ChangeDelete, ""},
+		{"/out", ChangeCreate, ""},
+		{"/out/a.txt", ChangeCreate, "hello"},
+		{"/src.txt", ChangeDelete, ""},
+	}
+	if len(cs) != len(want) {
+		t.Fatalf("bad changeset. want: %v got: %v", want, cs)
+	}
+	for i, c := range cs {
+		if c.Path != want[i].path || c.Op != want[i].op || string(c.Data) != want[i].data {
+			t.Errorf("bad change #%d. want: %v got: %v %v %q", i, want[i], c.Path, c.Op, c.Data)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cs.WriteTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	wantNames := []string{".wh.dir", "dst.txt", ".wh.gone.txt", "moved/", "moved/f.txt", "new.txt", ".wh.old.txt", "out/", "out/a.txt", ".wh.src.txt"}
+	if len(names) != len(wantNames) {
+		t.Fatalf("bad tar. want: %v got: %v", wantNames, names)
+	}
+	for i := range names {
+		if names[i] != wantNames[i] {
+			t.Errorf("bad tar entry #%d. want: %s got: %s", i, wantNames[i], names[i])
+		}
+	}
+}
+
+func TestChangesVirtual(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	wasi := NewWASI(WithFS(memfs), WithDevices(true), WithMount("/run", VirtualFS{
+		"state": &VirtualFile{
+			Read: func() ([]byte, error) {
+				reads++
+				return []byte("state"), nil
+			},
+			Write: func([]byte) error { return nil },
+		},
+	}))
+	for _, name := range []string{"/run/state", "/dev/null", "/real.txt"} {
+		fd, errno := wasi.open(rootFD, name, 0, libc.OflagCreat, 0, libc.RightFdWrite)
+		if errno != 0 {
+			t.Fatal("open", name, errno)
+		}
+		f, _ := wasi.get(fd)
+		if _, err := f.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		wasi.close(fd)
+	}
+	opened := reads
+
+	cs, err := wasi.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != opened {
+		t.Error("Changes read the virtual file")
+	}
+	if len(cs) != 1 || cs[0].Path != "/real.txt" {
+		t.Error("bad changes. want: only /real.txt got:", cs)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"unsafe"
 
-	"github.com/bytecodealliance/wasmtime-go/v11"
-
 	"github.com/guregu/hammertime/libc"
 )
 
@@ -19,7 +17,7 @@ func (strs charbuffer) size() libc.Size {
 	return size
 }
 
-func (strs charbuffer) writeSizes(caller *wasmtime.Caller, _argc, _argv int32) error {
+func (strs charbuffer) writeSizes(caller guest, _argc, _argv int32) error {
 	argc := libc.Ptr(_argc)
 	argv := libc.Ptr(_argv)
 	return ensure(caller, func(base unsafe.Pointer, _ []byte) {
@@ -28,7 +26,7 @@ func (strs charbuffer) writeSizes(caller *wasmtime.Caller, _argc, _argv int32) e
 	}, argc+libc.PtrSize, argv+libc.PtrSize)
 }
 
-func (strs charbuffer) write(caller *wasmtime.Caller, _listptr, _bufptr int32) error {
+func (strs charbuffer) write(caller guest, _listptr, _bufptr int32) error {
 	listptr := libc.Ptr(_listptr)
 	bufptr := libc.Ptr(_bufptr)
 	return ensure(caller, func(base unsafe.Pointer, data []byte) {
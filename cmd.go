@@ -0,0 +1,298 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+// Cmd is a Wasm command module being prepared or run, modelled after exec.Cmd.
+// It takes care of the engine, store, linker, and instance boilerplate.
+type Cmd struct {
+	// Wasm is the binary module to run.
+	Wasm []byte
+
+	// Args holds command line arguments, including the command as Args[0].
+	Args []string
+
+	// Env specifies the environment of the guest as "key=value" strings.
+	// Unlike exec.Cmd, the host environment is never inherited: nil means an empty environment.
+	Env []string
+
+	// Dir is the guest's working directory. See WithWorkingDir.
+	Dir string
+
+	// Stdin, Stdout, and Stderr are the guest's standard streams.
+	// A nil Stdin reads as empty, and a nil Stdout or Stderr discards output.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Options are additional WASI options, such as WithFS or WithHostDir.
+	Options []Option
+
+	// Engine compiles and runs the module.
+	// If nil, a new engine with epoch interruption enabled is used,
+	// so cancelling the context given to CommandContext stops the guest.
+	Engine *wasmtime.Engine
+
+	// EngineConfig describes Engine's configuration, to key its entries in Cache. See ModuleCache.Compile.
+	// If Engine is set but EngineConfig is empty, Cache isn't used.
+	EngineConfig string
+
+	// Cache, if set, stores the compiled module on disk to speed up later runs. See ModuleCache.
+	Cache *ModuleCache
+
+	ctx      context.Context
+	wasi     *Instance
+	done     chan error
+	finished bool
+	exitCode int
+
+	closeAfterRun  []io.Closer
+	closeAfterWait []io.Closer
+}
+
+// Command returns a Cmd to run the given Wasm module with the given arguments.
+// Like os/exec, args[0] should be the name of the command.
+func Command(wasm []byte, args ...string) *Cmd {
+	return &Cmd{
+		Wasm:     wasm,
+		Args:     args,
+		exitCode: -1,
+	}
+}
+
+// CommandContext is like Command but includes a context.
+// The guest is stopped if the context is done before it exits. See Instance.Call.
+func CommandContext(ctx context.Context, wasm []byte, args ...string) *Cmd {
+	if ctx == nil {
+		panic("nil Context")
+	}
+	cmd := Command(wasm, args...)
+	cmd.ctx = ctx
+	return cmd
+}
+
+// ExitError reports that the guest exited with a non-zero code.
+type ExitError struct {
+	Code int
+	// Stderr holds the guest's standard error output if it wasn't otherwise collected by Cmd.Output.
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Run starts the guest and waits for it to finish.
+// The returned error is nil if the guest returns from _start or exits with code 0,
+// *ExitError if it exits with another code, or the trap or context error that stopped it.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Start starts the guest but doesn't wait for it to finish.
+func (c *Cmd) Start() error {
+	if c.wasi != nil {
+		return errors.New("hammertime: already started")
+	}
+	if c.ctx == nil {
+		c.ctx = context.Background()
+	}
+	if err := c.start(); err != nil {
+		c.closeDescriptors(c.closeAfterRun)
+		c.closeDescriptors(c.closeAfterWait)
+		return err
+	}
+	return nil
+}
+
+func (c *Cmd) start() error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+
+	module, store, err := c.compile()
+	if err != nil {
+		return err
+	}
+
+	linker := wasmtime.NewLinker(store.Engine)
+	wasi := NewWASI(append(c.options(), c.Options...)...)
+	if err := wasi.Link(store, linker); err != nil {
+		wasi.Close()
+		return err
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		return err
+	}
+
+	c.wasi = wasi.Instance
+	c.done = make(chan error, 1)
+	go func() {
+		err := c.wasi.Run(c.ctx, store, instance)
+		c.closeDescriptors(c.closeAfterRun)
+		c.done <- err
+	}()
+	return nil
+}
+
+func (c *Cmd) compile() (*wasmtime.Module, *wasmtime.Store, error) {
+	if isComponent(c.Wasm) {
+		return nil, nil, ErrComponent
+	}
+	engine, config := c.Engine, c.EngineConfig
+	if engine == nil {
+		engine, config = newEpochEngine(), "epoch"
+	}
+	var module *wasmtime.Module
+	var err error
+	if c.Cache != nil && config != "" {
+		module, err = c.Cache.Compile(engine, config, c.Wasm)
+	} else {
+		module, err = wasmtime.NewModule(engine, c.Wasm)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return module, wasmtime.NewStore(engine), nil
+}
+
+// Wait waits for the guest to finish and releases its resources.
+// See Run for the meaning of the returned error.
+func (c *Cmd) Wait() error {
+	if c.wasi == nil {
+		return errors.New("hammertime: not started")
+	}
+	if c.finished {
+		return errors.New("hammertime: Wait was already called")
+	}
+	err := <-c.done
+	c.finished = true
+	c.exitCode, err = c.wasi.exitStatus(err)
+	c.wasi.Close()
+	c.closeDescriptors(c.closeAfterWait)
+	return err
+}
+
+// ExitCode returns the exit code of the finished guest.
+// It returns 0 if the guest returned from _start,
+// or -1 if it hasn't finished or was stopped by a trap or its context.
+func (c *Cmd) ExitCode() int {
+	return c.exitCode
+}
+
+// Output runs the guest and returns its standard output.
+// If Stderr is nil, standard error is collected into the returned *ExitError.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("hammertime: Stdout already set")
+	}
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+
+	var stderr *bytes.Buffer
+	if c.Stderr == nil {
+		stderr = new(bytes.Buffer)
+		c.Stderr = stderr
+	}
+
+	err := c.Run()
+	var ee *ExitError
+	if errors.As(err, &ee) && stderr != nil {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the guest and returns its standard output and standard error combined.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("hammertime: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("hammertime: Stderr already set")
+	}
+	var b bytes.Buffer
+	c.Stdout = &b
+	c.Stderr = &b
+	err := c.Run()
+	return b.Bytes(), err
+}
+
+// StdoutPipe returns a pipe connected to the guest's standard output.
+// The pipe is closed after the guest finishes and Wait closes the reading end,
+// so it is incorrect to call Wait (or Run) before all reads from the pipe have completed.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("hammertime: Stdout already set")
+	}
+	if c.wasi != nil {
+		return nil, errors.New("hammertime: StdoutPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.Stdout = pw
+	c.closeAfterRun = append(c.closeAfterRun, pw)
+	c.closeAfterWait = append(c.closeAfterWait, pr)
+	return pr, nil
+}
+
+// exitStatus returns the guest's exit code and error, given the result of running _start.
+// The code is -1 if the guest was stopped by a trap.
+func (wasi *Instance) exitStatus(err error) (int, error) {
+	// proc_exit(0) doesn't trap, so the guest usually traps on an unreachable afterwards
+	if code, exited := wasi.ExitCode(); exited {
+		if code != 0 {
+			return code, &ExitError{Code: code}
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+func (c *Cmd) options() []Option {
+	env := make(map[string]string, len(c.Env))
+	for _, kv := range c.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	opts := []Option{
+		WithArgs(c.Args),
+		WithEnv(env),
+		WithStdin(c.Stdin),
+		WithStdout(orDiscard(c.Stdout)),
+		WithStderr(orDiscard(c.Stderr)),
+	}
+	if c.Dir != "" {
+		opts = append(opts, WithWorkingDir(c.Dir))
+	}
+	return opts
+}
+
+func (c *Cmd) closeDescriptors(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
@@ -0,0 +1,118 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+func TestCommand(t *testing.T) {
+	// writes "out\n" to stdout and "err\n" to stderr, then exits with argc-1
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "args_sizes_get" (func $argsizes (param i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+		(memory (export "memory") 1)
+		(data (i32.const 64) "out\n")
+		(data (i32.const 68) "err\n")
+		(func (export "_start")
+			(i32.store (i32.const 0) (i32.const 64))
+			(i32.store (i32.const 4) (i32.const 4))
+			(drop (call $write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+			(i32.store (i32.const 0) (i32.const 68))
+			(drop (call $write (i32.const 2) (i32.const 0) (i32.const 1) (i32.const 8)))
+			(drop (call $argsizes (i32.const 16) (i32.const 20)))
+			(call $exit (i32.sub (i32.load (i32.const 16)) (i32.const 1)))
+			unreachable))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop, err := wasmtime.Wat2Wasm(`(module (func (export "_start") (loop $l (br $l))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Output", func(t *testing.T) {
+		cmd := Command(wasm, "prog")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "out\n" || cmd.ExitCode() != 0 {
+			t.Error("bad output. want: out 0 got:", string(out), cmd.ExitCode())
+		}
+	})
+
+	t.Run("ExitError", func(t *testing.T) {
+		cmd := Command(wasm, "prog", "a", "b")
+		_, err := cmd.Output()
+		var ee *ExitError
+		if !errors.As(err, &ee) || ee.Code != 2 || string(ee.Stderr) != "err\n" {
+			t.Fatal("want exit status 2 with stderr, got:", err)
+		}
+		if cmd.ExitCode() != 2 {
+			t.Error("bad exit code. want: 2 got:", cmd.ExitCode())
+		}
+	})
+
+	t.Run("CombinedOutput", func(t *testing.T) {
+		out, err := Command(wasm, "prog").CombinedOutput()
+		if err != nil || string(out) != "out\nerr\n" {
+			t.Error("bad output:", string(out), err)
+		}
+	})
+
+	t.Run("StdoutPipe", func(t *testing.T) {
+		cmd := Command(wasm, "prog")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "out\n" {
+			t.Error("bad output:", string(out))
+		}
+	})
+
+	t.Run("Component", func(t *testing.T) {
+		// empty component: magic, version 13, layer 1
+		component := []byte("\x00asm\x0d\x00\x01\x00")
+		if err := Command(component, "component").Run(); !errors.Is(err, ErrComponent) {
+			t.Error("want:", ErrComponent, "got:", err)
+		}
+		if _, err := NewPool(component, 1); !errors.Is(err, ErrComponent) {
+			t.Error("pool: want:", ErrComponent, "got:", err)
+		}
+		cache := &ModuleCache{Dir: t.TempDir()}
+		if _, err := cache.Compile(wasmtime.NewEngine(), "", component); !errors.Is(err, ErrComponent) {
+			t.Error("cache: want:", ErrComponent, "got:", err)
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		cmd := CommandContext(ctx, loop, "loop")
+		if err := cmd.Run(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("want:", context.DeadlineExceeded, "got:", err)
+		}
+		if cmd.ExitCode() != -1 {
+			t.Error("bad exit code. want: -1 got:", cmd.ExitCode())
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package hammertime
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrComponent is returned when trying to run a WASI preview2 component.
+// hammertime implements preview1 for core modules only:
+// neither wasmtime-go nor wazero can instantiate components yet,
+// so there's nothing to hang wasi:cli, wasi:filesystem, and friends on.
+var ErrComponent = errors.New("hammertime: WASI preview2 components are not supported, only core modules")
+
+// isComponent reports whether wasm is a component rather than a core module.
+// Both start with the same magic number, but components are layer 1.
+func isComponent(wasm []byte) bool {
+	return len(wasm) >= 8 && bytes.Equal(wasm[:4], []byte("\x00asm")) && wasm[6] == 1 && wasm[7] == 0
+}
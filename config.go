@@ -28,9 +28,45 @@ func WithEnv(env map[string]string) Option {
 }
 
 // WithFS uses the given filesystem.
+//
+// Several WASIs may use the same filesystem at the same time. Within a process, for instances using the same
+// fs.FS value (such as the same *mem.FS), or host directories from WithHostDir under the same top-level directory:
+//   - Creating a file with O_EXCL is atomic: exactly one of the instances racing to create it succeeds.
+//   - Creating, renaming, and removing files and directories are serialized, so an instance never
+//     observes a half-finished change made by another, as long as the underlying Rename and Remove are atomic.
+//   - fd_readdir lists a snapshot of the directory taken by the first read of each fd.
+//
+// Two different values wrapping the same data aren't recognized as shared,
+// and other processes aren't coordinated with.
 func WithFS(fsys fs.FS) Option {
 	return func(wasi *WASI) {
-		wasi.fs = fsys
+		wasi.root = fsys
+	}
+}
+
+// WithMount mounts fsys at the given guest path, on top of the filesystem given by WithFS.
+// The mount point doesn't need to exist.
+func WithMount(guestPath string, fsys fs.FS) Option {
+	return func(wasi *WASI) {
+		wasi.mounts = append(wasi.mounts, mountpoint{path: guestPath, fs: fsys})
+	}
+}
+
+// WithCreateMode sets the permissions given to files and directories created by the guest,
+// before applying the umask. Zero means the default: 0644 for files and 0755 for directories.
+func WithCreateMode(file, dir fs.FileMode) Option {
+	return func(wasi *WASI) {
+		wasi.modes.file = file.Perm()
+		wasi.modes.dir = dir.Perm()
+	}
+}
+
+// WithUmask sets the umask, which removes permissions from newly created files and directories.
+// The default is 0, as the modes given by WithCreateMode are already restrictive.
+// Note that host directories are additionally subject to the host process's umask.
+func WithUmask(mask fs.FileMode) Option {
+	return func(wasi *WASI) {
+		wasi.modes.umask = mask.Perm()
 	}
 }
 
@@ -63,6 +99,22 @@ func WithStderr(w io.Writer) Option {
 	}
 }
 
+// WithRandom sets the source of randomness used by random_get and /dev/urandom.
+// By default, crypto/rand.Reader is used.
+func WithRandom(r io.Reader) Option {
+	return func(wasi *WASI) {
+		wasi.random = r
+	}
+}
+
+// WithDevices mounts a synthetic /dev containing null, zero, random, urandom, stdin, stdout, and stderr.
+// The std* devices alias file descriptors 0-2.
+func WithDevices(enable bool) Option {
+	return func(wasi *WASI) {
+		wasi.devices = enable
+	}
+}
+
 // WithDebug enables spammy debug logs.
 func WithDebug(debug bool) Option {
 	return func(wasi *WASI) {
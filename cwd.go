@@ -0,0 +1,150 @@
+package hammertime
+
+import (
+	"unsafe"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// wasixModule is the namespace used for the WASIX-style getcwd and chdir extensions.
+const wasixModule = "wasix_32v1"
+
+// WithWorkingDir sets the guest's initial working directory.
+// It preopens "." at dir, so relative paths resolve from there.
+// Note that wasi-libc picks the most recently preopened directory when prefixes tie,
+// so guests built with it will resolve absolute paths from dir as well, same as wasmtime's --dir.
+func WithWorkingDir(dir string) Option {
+	return func(wasi *WASI) {
+		wasi.workdir = dir
+	}
+}
+
+// WithChdir enables WASIX-style getcwd and chdir host functions (in the wasix_32v1 module),
+// allowing the guest to change its working directory during the run.
+func WithChdir(enable bool) Option {
+	return func(wasi *WASI) {
+		wasi.chdirext = enable
+	}
+}
+
+// Getwd returns the guest's current working directory.
+func (wasi *Instance) Getwd() string {
+	return wasi.getwd()
+}
+
+// preopenWorkdir preopens "." at the given guest directory.
+func (fsys *filesystem) preopenWorkdir(dir string) libc.Errno {
+	if fsys.fs == nil {
+		return libc.ErrnoNosys
+	}
+	path, errno := fsys.resolve(".", dir, true)
+	if errno != libc.ErrnoSuccess {
+		return errno
+	}
+	if errno := fsys.isDir(path); errno != libc.ErrnoSuccess {
+		return errno
+	}
+	fd := &filedesc{
+		fdstat:  &libc.Fdstat{Filetype: libc.FiletypeDirectory},
+		preopen: ".",
+		path:    path,
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fd.no = fsys.nextfd
+	fsys.nextfd++
+	fsys.fds[fd.no] = fd
+	fsys.cwd = fd
+	return libc.ErrnoSuccess
+}
+
+func (fsys *filesystem) getwd() string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.cwd == nil || fsys.cwd.path == "." {
+		return "/"
+	}
+	return "/" + fsys.cwd.path
+}
+
+func (fsys *filesystem) chdir(name string) libc.Errno {
+	if fsys.fs == nil {
+		return libc.ErrnoNosys
+	}
+	fsys.mu.Lock()
+	cwd := fsys.cwd
+	dir := "."
+	if cwd != nil {
+		dir = cwd.path
+	}
+	fsys.mu.Unlock()
+	path, errno := fsys.resolveAllowed(OpStat, dir, name, true)
+	if errno != libc.ErrnoSuccess {
+		return errno
+	}
+	if cwd == nil {
+		return fsys.preopenWorkdir("/" + path)
+	}
+	if errno := fsys.isDir(path); errno != libc.ErrnoSuccess {
+		return errno
+	}
+	fsys.mu.Lock()
+	cwd.path = path
+	fsys.mu.Unlock()
+	return libc.ErrnoSuccess
+}
+
+// isDir checks that the resolved path is a directory, for use as the working directory.
+func (fsys *filesystem) isDir(path string) libc.Errno {
+	info, err := fsys.lstat(path)
+	if err != nil {
+		return libc.Error(err)
+	}
+	if !info.IsDir() {
+		return libc.ErrnoNotdir
+	}
+	return libc.ErrnoSuccess
+}
+
+func (wasi *Instance) getcwd(caller guest, _buf, _lenptr libc.Int) (libc.Int, *trap) {
+	buf := libc.Ptr(_buf)
+	lenptr := libc.Ptr(_lenptr)
+	wasi.debugln("getcwd", buf, lenptr)
+
+	cwd := wasi.getwd()
+	var errno libc.Errno
+	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
+		size := (*libc.Size)(unsafe.Add(base, lenptr))
+		if *size < libc.Size(len(cwd)) {
+			*size = libc.Size(len(cwd))
+			errno = libc.ErrnoRange
+			return
+		}
+		if int(buf)+len(cwd) > len(data) {
+			errno = libc.ErrnoFault
+			return
+		}
+		copy(data[buf:], cwd)
+		*size = libc.Size(len(cwd))
+	}, lenptr+libc.PtrSize)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return errno, nil
+}
+
+func (wasi *Instance) chdir_(caller guest, _path, _pathlen libc.Int) (libc.Int, *trap) {
+	path := libc.Ptr(_path)
+	pathlen := libc.Size(_pathlen)
+
+	var errno libc.Errno
+	err := ensure(caller, func(_ unsafe.Pointer, data []byte) {
+		name := string(data[path : path+pathlen])
+		errno = wasi.chdir(name)
+		wasi.debugf("chdir(%q) → %d", name, errno)
+	}, path+pathlen)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return errno, nil
+}
@@ -0,0 +1,145 @@
+package hammertime
+
+import (
+	"io"
+	"io/fs"
+	"syscall"
+
+	"github.com/hack-pad/hackpadfs"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+const deviceMode = fs.ModeDevice | fs.ModeCharDevice | 0666
+
+var deviceNames = []string{"null", "random", "stderr", "stdin", "stdout", "urandom", "zero"}
+
+// devfs is a synthetic /dev with a few commonly used character devices.
+type devfs struct {
+	fsys   *filesystem
+	random io.Reader
+}
+
+// Open implements fs.FS.
+func (dev *devfs) Open(name string) (fs.File, error) {
+	return dev.OpenFile(name, hackpadfs.FlagReadOnly, 0)
+}
+
+// OpenFile implements hackpadfs.OpenFileFS.
+func (dev *devfs) OpenFile(name string, flag int, _ fs.FileMode) (hackpadfs.File, error) {
+	if name == "." {
+		ents := make([]fs.DirEntry, 0, len(deviceNames))
+		for _, name := range deviceNames {
+			ents = append(ents, fs.FileInfoToDirEntry(deviceinfo(name)))
+		}
+		return &vdir{info: dirinfo("dev"), entries: ents}, nil
+	}
+
+	d := &device{name: name}
+	switch name {
+	case "null":
+		d.Writer = io.Discard
+	case "zero":
+		d.Reader = zeroReader{}
+		d.Writer = io.Discard
+	case "random", "urandom":
+		d.Reader = dev.random
+		d.Writer = io.Discard
+	case "stdin":
+		d.Reader = dev.stdio(0)
+	case "stdout":
+		d.Writer = dev.stdio(1)
+	case "stderr":
+		d.Writer = dev.stdio(2)
+	default:
+		if flag&hackpadfs.FlagCreate != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return d, nil
+}
+
+// Stat implements hackpadfs.StatFS.
+func (dev *devfs) Stat(name string) (fs.FileInfo, error) {
+	f, err := dev.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Stat()
+}
+
+// stdio returns the stream currently backing the given standard fd.
+func (dev *devfs) stdio(fd libc.Int) *stdioDevice {
+	return &stdioDevice{fsys: dev.fsys, fd: fd}
+}
+
+type device struct {
+	name string
+	io.Reader
+	io.Writer
+}
+
+func (d *device) Stat() (fs.FileInfo, error) {
+	return deviceinfo(d.name), nil
+}
+
+func (d *device) Read(p []byte) (int, error) {
+	if d.Reader == nil {
+		return 0, io.EOF
+	}
+	return d.Reader.Read(p)
+}
+
+func (d *device) Write(p []byte) (int, error) {
+	if d.Writer == nil {
+		return 0, &fs.PathError{Op: "write", Path: d.name, Err: syscall.EBADF}
+	}
+	return d.Writer.Write(p)
+}
+
+func (d *device) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *device) Close() error {
+	return nil
+}
+
+func deviceinfo(name string) fileinfo {
+	return fileinfo{
+		name: name,
+		mode: deviceMode,
+	}
+}
+
+// stdioDevice aliases one of the standard file descriptors (0-2).
+type stdioDevice struct {
+	fsys *filesystem
+	fd   libc.Int
+}
+
+func (s *stdioDevice) Read(p []byte) (int, error) {
+	f, errno := s.fsys.get(s.fd)
+	if errno != libc.ErrnoSuccess {
+		return 0, syscall.EBADF
+	}
+	return f.Read(p)
+}
+
+func (s *stdioDevice) Write(p []byte) (int, error) {
+	f, errno := s.fsys.get(s.fd)
+	if errno != libc.ErrnoSuccess {
+		return 0, syscall.EBADF
+	}
+	return f.Write(p)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
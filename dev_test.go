@@ -0,0 +1,62 @@
+package hammertime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestDevices(t *testing.T) {
+	stdout := new(bytes.Buffer)
+	wasi := NewWASI(
+		WithStdout(stdout),
+		WithRandom(strings.NewReader("xyz")),
+		WithDevices(true),
+	)
+
+	fd, errno := wasi.open(rootFD, "/dev/stdout", 0, 0, 0, libc.RightFdWrite)
+	if errno != 0 {
+		t.Fatal("open stdout", errno)
+	}
+	stat, _ := wasi.fdstat(fd)
+	if stat.Filetype != libc.FiletypeCharacterDevice {
+		t.Error("bad filetype. want:", libc.FiletypeCharacterDevice, "got:", stat.Filetype)
+	}
+	f, _ := wasi.get(fd)
+	f.Write([]byte("hello"))
+	if got := stdout.String(); got != "hello" {
+		t.Error("bad stdout. want: hello got:", got)
+	}
+
+	fd, errno = wasi.open(rootFD, "/dev/urandom", 0, 0, 0, libc.RightFdRead)
+	if errno != 0 {
+		t.Fatal("open urandom", errno)
+	}
+	f, _ = wasi.get(fd)
+	buf := make([]byte, 3)
+	f.Read(buf)
+	if string(buf) != "xyz" {
+		t.Error("bad urandom. want: xyz got:", string(buf))
+	}
+
+	if _, errno := wasi.open(rootFD, "/dev/nope", 0, libc.OflagCreat, 0, libc.RightFdWrite); errno != libc.ErrnoPerm {
+		t.Error("bad errno creating device. want:", libc.ErrnoPerm, "got:", errno)
+	}
+
+	var names []string
+	for cookie := int64(0); ; cookie++ {
+		_, name, errno := wasi.readdir(rootFD, cookie)
+		if errno != 0 {
+			t.Fatal("readdir", errno)
+		}
+		if name == "" {
+			break
+		}
+		names = append(names, name)
+	}
+	if len(names) != 1 || names[0] != "dev" {
+		t.Error("bad root listing. want: [dev] got:", names)
+	}
+}
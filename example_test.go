@@ -1,3 +1,5 @@
+//go:build cgo
+
 package hammertime
 
 import (
@@ -45,3 +47,22 @@ func Example() {
 	// 1: hello
 	// 2: world
 }
+
+func ExampleCommand() {
+	wasm, err := os.ReadFile(filepath.Join("testdata", "args.wasm"))
+	if err != nil {
+		panic(err)
+	}
+
+	cmd := Command(wasm, "args.wasm", "hello", "world")
+	stdout, err := cmd.Output()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(string(stdout))
+	// Output: 3
+	// 0: args.wasm
+	// 1: hello
+	// 2: world
+}
@@ -0,0 +1,19 @@
+package hammertime
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// hostFilestat fills in fstat with extra info from the host OS, if available.
+func hostFilestat(info fs.FileInfo, fstat *libc.Filestat) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	fstat.Nlink = uint64(st.Nlink)
+	fstat.Atim = uint64(syscall.TimespecToNsec(st.Atim))
+	fstat.Ctim = uint64(syscall.TimespecToNsec(st.Ctim))
+}
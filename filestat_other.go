@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package hammertime
+
+import (
+	"io/fs"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// hostFilestat fills in fstat with extra info from the host OS, if available.
+func hostFilestat(info fs.FileInfo, fstat *libc.Filestat) {}
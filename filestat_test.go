@@ -0,0 +1,65 @@
+package hammertime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestFilestat(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	wasi := NewWASI(WithHostDir("/", dir, DirReadOnly), WithDevices(true))
+
+	stdout, errno := wasi.stat(1)
+	if errno != 0 {
+		t.Fatal("stat stdout", errno)
+	}
+	if stdout.Filetype != libc.FiletypeCharacterDevice {
+		t.Error("bad stdout filetype. want:", libc.FiletypeCharacterDevice, "got:", stdout.Filetype)
+	}
+
+	a, errno := wasi.statAt(rootFD, "a.txt", true)
+	if errno != 0 {
+		t.Fatal("stat", errno)
+	}
+	if a.Filetype != libc.FiletypeRegularFile || a.Size != 5 || a.Nlink != 2 {
+		t.Errorf("bad stat: %+v", a)
+	}
+	if a.Atim == 0 || a.Mtim == 0 || a.Ctim == 0 {
+		t.Errorf("missing timestamps: %+v", a)
+	}
+	b, _ := wasi.statAt(rootFD, "b.txt", true)
+	if b.Ino != a.Ino || b.Dev != a.Dev {
+		t.Error("hard links have different inodes:", a.Ino, b.Ino)
+	}
+
+	link, errno := wasi.statAt(rootFD, "c.txt", false)
+	if errno != 0 {
+		t.Fatal("lstat", errno)
+	}
+	if link.Filetype != libc.FiletypeSymbolicLink {
+		t.Error("bad symlink filetype. want:", libc.FiletypeSymbolicLink, "got:", link.Filetype)
+	}
+	if target, _ := wasi.statAt(rootFD, "c.txt", true); target.Ino != a.Ino {
+		t.Error("symlink not followed")
+	}
+
+	null, errno := wasi.statAt(rootFD, "dev/null", true)
+	if errno != 0 {
+		t.Fatal("stat /dev/null", errno)
+	}
+	if null.Filetype != libc.FiletypeCharacterDevice {
+		t.Error("bad /dev/null filetype. want:", libc.FiletypeCharacterDevice, "got:", null.Filetype)
+	}
+}
@@ -1,11 +1,12 @@
 package hammertime
 
 import (
-	"hash/crc64"
+	"context"
+	"errors"
 	"io"
 	"io/fs"
 	"path"
-	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,22 +18,33 @@ import (
 const (
 	stdioMaxFD = 3
 	rootFD     = 3
+	createMode = 0644
 	mkdirMode  = 0755
 )
 
 type filesystem struct {
+	// mu guards the fd table and everything else that changes as the guest runs,
+	// including the paths of open fds. It is never held while doing I/O.
+	mu sync.Mutex
+
 	fds    map[libc.Int]*filedesc
 	nextfd libc.Int
 	fs     hackpadfs.FS
-	dev    uint64
+
+	changes changelog
+	inodes  map[string]*inodeTable // mount point → table
+	cwd     *filedesc              // preopened working directory, if any
+	quota   quota
+	perms   perms
+	policy  Policy
 }
 
-func newFilesystem(fsys fs.FS, stdin io.Reader, stdout, stderr io.Writer) *filesystem {
-	system := &filesystem{
-		fds:    map[int32]*filedesc{},
-		fs:     fsys,
-		nextfd: stdioMaxFD + 1,
-	}
+func (system *filesystem) init(fsys fs.FS, stdin io.Reader, stdout, stderr io.Writer) {
+	system.fds = map[int32]*filedesc{}
+	system.fs = fsys
+	system.nextfd = stdioMaxFD + 1
+	system.changes = make(changelog)
+
 	fd0 := newStream(stdin)
 	fd1 := newStream(stdout)
 	fd2 := newStream(stderr)
@@ -40,18 +52,46 @@ func newFilesystem(fsys fs.FS, stdin io.Reader, stdout, stderr io.Writer) *files
 	system.set(1, fd1)
 	system.set(2, fd2)
 	if fsys != nil {
-		fd3 := &filedesc{
-			no:      3,
-			fdstat:  &libc.Fdstat{Filetype: libc.FiletypeDirectory},
-			preopen: "/",
-		}
-		system.set(3, fd3)
+		system.preopenRoot()
 	}
+}
 
-	return system
+func (fsys *filesystem) preopenRoot() {
+	if _, errno := fsys.get(rootFD); errno == libc.ErrnoSuccess {
+		return
+	}
+	fd3 := &filedesc{
+		no:      rootFD,
+		fdstat:  &libc.Fdstat{Filetype: libc.FiletypeDirectory},
+		preopen: "/",
+		path:    ".",
+	}
+	fsys.set(rootFD, fd3)
+}
+
+// mount attaches mfs at the given guest path, on top of the user's filesystem.
+// Mounting at "/" replaces the root.
+func (fsys *filesystem) mount(name string, mfs hackpadfs.FS) {
+	defer fsys.preopenRoot()
+	m, ok := fsys.fs.(*mountfs)
+	if cleanPath(name) == "." {
+		if ok {
+			m.root = mfs
+		} else {
+			fsys.fs = mfs
+		}
+		return
+	}
+	if !ok {
+		m = newMountFS(fsys.fs)
+		fsys.fs = m
+	}
+	m.add(name, mfs)
 }
 
 func (fsys *filesystem) set(no libc.Int, fd *filedesc) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
 	fd.no = no
 	fsys.fds[no] = fd
 	if fsys.nextfd <= no {
@@ -60,6 +100,8 @@ func (fsys *filesystem) set(no libc.Int, fd *filedesc) {
 }
 
 func (fsys *filesystem) get(fd libc.Int) (*filedesc, libc.Errno) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
 	f, ok := fsys.fds[fd]
 	if !ok {
 		return nil, libc.ErrnoBadf
@@ -67,16 +109,6 @@ func (fsys *filesystem) get(fd libc.Int) (*filedesc, libc.Errno) {
 	return f, libc.ErrnoSuccess
 }
 
-var crctab = crc64.MakeTable(crc64.ECMA)
-
-func (fsys *filesystem) ino(fd libc.Int, name string) uint64 {
-	// TODO: should use abs path
-	if name == "" {
-		name = "/proc/fd/" + strconv.Itoa(int(fd))
-	}
-	return crc64.Checksum([]byte(name), crctab)
-}
-
 func (fsys *filesystem) fdstat(fd libc.Int) (*libc.Fdstat, libc.Errno) {
 	f, errno := fsys.get(fd)
 	if errno != libc.ErrnoSuccess {
@@ -90,130 +122,353 @@ func (fsys *filesystem) stat(fd libc.Int) (*libc.Filestat, libc.Errno) {
 	if errno != libc.ErrnoSuccess {
 		return nil, errno
 	}
-	stat, err := f.Stat()
+	fpath := fsys.pathOf(f)
+	var stat fs.FileInfo
+	var err error
+	if f.preopen != "" {
+		stat, err = hackpadfs.Stat(fsys.fs, fpath)
+	} else {
+		stat, err = f.Stat()
+	}
 	if err != nil {
 		return nil, libc.Error(err)
 	}
 
-	fstat := &libc.Filestat{
-		Dev:   fsys.dev,
-		Ino:   fsys.ino(fd, stat.Name()),
-		Mtim:  uint64(stat.ModTime().UnixNano()),
-		Nlink: 1,
-		Size:  uint64(stat.Size()),
-	}
-	if stat.IsDir() {
-		fstat.Filetype = libc.FiletypeDirectory
+	fstat := newFilestat(stat)
+	switch {
+	case fpath != "":
+		fstat.Dev, fstat.Ino = fsys.ino(fpath, stat)
+	default:
+		// stdio streams and such
+		var ok bool
+		if fstat.Dev, fstat.Ino, ok = hostIno(stat); !ok {
+			fstat.Dev, fstat.Ino = syntheticDev, uint64(fd)+1
+		}
+	}
+	return fstat, libc.ErrnoSuccess
+}
+
+// statAt stats the file at name, relative to the directory fd.
+func (fsys *filesystem) statAt(fd libc.Int, name string, follow bool) (*libc.Filestat, libc.Errno) {
+	if fsys.fs == nil {
+		return nil, libc.ErrnoNosys
+	}
+	name, errno := fsys.rel(OpStat, fd, name, follow)
+	if errno != libc.ErrnoSuccess {
+		return nil, errno
+	}
+	var stat fs.FileInfo
+	var err error
+	if follow {
+		stat, err = hackpadfs.Stat(fsys.fs, name)
 	} else {
-		fstat.Filetype = libc.FiletypeRegularFile // TODO
+		stat, err = fsys.lstat(name)
+	}
+	if err != nil {
+		return nil, libc.Error(err)
 	}
+	fstat := newFilestat(stat)
+	fstat.Dev, fstat.Ino = fsys.ino(name, stat)
 	return fstat, libc.ErrnoSuccess
 }
 
+func newFilestat(stat fs.FileInfo) *libc.Filestat {
+	mtim := timestamp(stat.ModTime())
+	fstat := &libc.Filestat{
+		Filetype: filetype(stat.Mode()),
+		Nlink:    1,
+		Size:     uint64(stat.Size()),
+		Atim:     mtim,
+		Mtim:     mtim,
+		Ctim:     mtim,
+	}
+	// fill in the rest from the host, if possible
+	hostFilestat(stat, fstat)
+	return fstat
+}
+
+// filetype converts a Go file mode to a WASI file type.
+func filetype(mode fs.FileMode) libc.Filetype {
+	switch {
+	case mode.IsRegular():
+		return libc.FiletypeRegularFile
+	case mode.IsDir():
+		return libc.FiletypeDirectory
+	case mode&fs.ModeCharDevice != 0:
+		return libc.FiletypeCharacterDevice
+	case mode&fs.ModeDevice != 0:
+		return libc.FiletypeBlockDevice
+	case mode&fs.ModeSymlink != 0:
+		return libc.FiletypeSymbolicLink
+	case mode&fs.ModeSocket != 0:
+		return libc.FiletypeSocketStream
+	}
+	return libc.FiletypeUnknown
+}
+
+// timestamp converts t to nanoseconds since the Unix epoch, or zero if unknown.
+func timestamp(t time.Time) uint64 {
+	if t.IsZero() || t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
 func (fsys *filesystem) open(basefd libc.Int, path string, dirflags libc.Lookupflag, oflags libc.Oflag, fdflags libc.Fdflag, rights libc.Rights) (libc.Int, libc.Errno) {
 	if fsys.fs == nil {
 		return 0, libc.ErrnoNosys
 	}
-	path, errno := fsys.rel(basefd, path)
+	flags := libc.OpenFileFlags(dirflags, oflags, fdflags, rights)
+	if flags.Directory && flags.Create {
+		return 0, libc.ErrnoInval
+	}
+	op := OpRead
+	if flags.Write {
+		op = OpWrite
+	}
+	path, errno := fsys.rel(op, basefd, path, !flags.NoFollow)
 	if errno != libc.ErrnoSuccess {
 		return 0, errno
 	}
-	flags := libc.OpenFileFlags(dirflags, oflags, fdflags, rights)
+	if flags.Create {
+		// other instances sharing the filesystem must not create it between our check and OpenFile
+		defer fsys.lockShared(path)()
+	}
 
-	// TODO: figure out mode
-	f, err := hackpadfs.OpenFile(fsys.fs, path, flags, 0755)
-	if err != nil {
+	// check the flags ourselves, in case the filesystem doesn't know about them
+	info, err := fsys.lstat(path)
+	existed := err == nil
+	switch {
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
 		return 0, libc.Error(err)
+	case !existed && !flags.Create:
+		return 0, libc.ErrnoNoent
+	case !existed:
+	case flags.Create && flags.Exclusive:
+		return 0, libc.ErrnoExist
+	case info.Mode()&fs.ModeSymlink != 0:
+		// only possible with NoFollow
+		return 0, libc.ErrnoLoop
+	case flags.Directory && !info.IsDir():
+		return 0, libc.ErrnoNotdir
+	case info.IsDir() && flags.Write:
+		return 0, libc.ErrnoIsdir
+	}
+
+	if !existed {
+		if errno := fsys.allow(OpCreate, path); errno != libc.ErrnoSuccess {
+			return 0, errno
+		}
+	}
+	if hostFlags(flags) != hackpadfs.FlagReadOnly && !fsys.writable(path) {
+		return 0, libc.ErrnoRofs
+	}
+	if !existed {
+		if err := fsys.quota.create(); err != nil {
+			return 0, libc.Error(err)
+		}
 	}
 
-	fd := fsys.nextfd
-	fsys.nextfd++ // TODO: handle overflow
+	f, err := hackpadfs.OpenFile(fsys.fs, path, hostFlags(flags), fsys.perms.fileMode())
+	if err != nil {
+		if !existed {
+			fsys.quota.release()
+		}
+		return 0, libc.Error(err)
+	}
 
 	var desc *filedesc
 	desc, errno = newFile(f)
-	desc.no = fd
+	if errno != libc.ErrnoSuccess {
+		f.Close()
+		return 0, errno
+	}
+	if flags.Directory && desc.fdstat.Filetype != libc.FiletypeDirectory {
+		f.Close()
+		return 0, libc.ErrnoNotdir
+	}
+	if flags.Truncate && flags.Write && existed && desc.fdstat.Filetype == libc.FiletypeRegularFile {
+		if stat, err := f.Stat(); err == nil && stat.Size() > 0 {
+			if err := hackpadfs.TruncateFile(f, 0); err != nil {
+				f.Close()
+				return 0, libc.Error(err)
+			}
+		}
+	}
+
 	desc.fdstat.Flags = fdflags
 	desc.fdstat.RightsBase = rights
+	if desc.fdstat.Filetype == libc.FiletypeRegularFile {
+		desc.quota = &fsys.quota
+	}
 
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fd := fsys.nextfd
+	fsys.nextfd++ // TODO: handle overflow
+	desc.no = fd
+	desc.path = path
+
+	// devices and such aren't interesting changes
+	if ft := desc.fdstat.Filetype; ft == libc.FiletypeRegularFile || ft == libc.FiletypeDirectory {
+		switch {
+		case !existed:
+			fsys.changes.create(path)
+		case flags.Write:
+			fsys.changes.modify(path)
+		}
+	}
 	fsys.fds[fd] = desc
 	fsys.share(desc)
 	return fd, errno
 }
 
+// writable reports whether the filesystem (or mount) containing name supports any kind of modification.
+// Plain fs.FS implementations without hackpadfs extensions are treated as read-only.
+func (fsys *filesystem) writable(name string) bool {
+	switch fsys.backing(name).(type) {
+	case hackpadfs.OpenFileFS, hackpadfs.MkdirFS, hackpadfs.RemoveFS, hackpadfs.RenameFS:
+		return true
+	}
+	return false
+}
+
+// hostFlags converts flags to the os-style flags that hackpadfs expects.
+// Flags that we handle ourselves (Directory, NoFollow) are left out,
+// so that read-only opens work with any fs.FS.
+func hostFlags(flags libc.OpenFlags) int {
+	var hf int
+	switch {
+	case flags.Read && flags.Write:
+		hf = hackpadfs.FlagReadWrite
+	case flags.Write:
+		hf = hackpadfs.FlagWriteOnly
+	default:
+		hf = hackpadfs.FlagReadOnly
+	}
+	if flags.Create {
+		hf |= hackpadfs.FlagCreate
+	}
+	if flags.Create && flags.Exclusive {
+		hf |= hackpadfs.FlagExclusive
+	}
+	if flags.Truncate && flags.Write {
+		hf |= hackpadfs.FlagTruncate
+	}
+	if flags.Append && flags.Write {
+		hf |= hackpadfs.FlagAppend
+	}
+	if flags.Sync && flags.Write {
+		hf |= hackpadfs.FlagSync
+	}
+	return hf
+}
+
 func (fsys *filesystem) close(fd libc.Int) libc.Errno {
 	desc, errno := fsys.get(fd)
 	if errno != libc.ErrnoSuccess {
 		return errno
 	}
-	fsys.unshare(desc)
-	return libc.ErrnoSuccess
+	return fsys.unshare(desc)
 }
 
-func (fsys *filesystem) rel(fd int32, name string) (string, libc.Errno) {
-	name = cleanPath(name)
-	if fd == 0 || (fsys.fs != nil && fd == rootFD) {
-		return name, libc.ErrnoSuccess
-	}
-	f, errno := fsys.get(fd)
-	if errno != libc.ErrnoSuccess {
-		return "", errno
-	}
-	name, errno = f.rel(name)
-	if errno != libc.ErrnoSuccess {
-		return "", errno
+// rel resolves name relative to the directory fd, safely.
+// If follow is false, a symlink in the last component of name is not followed.
+// It fails if the policy doesn't allow op on name, whether as given or as resolved.
+func (fsys *filesystem) rel(op Op, fd int32, name string, follow bool) (string, libc.Errno) {
+	dir := "."
+	if fd != 0 && !(fsys.fs != nil && fd == rootFD) {
+		f, errno := fsys.get(fd)
+		if errno != libc.ErrnoSuccess {
+			return "", errno
+		}
+		dir, errno = fsys.dir(f)
+		if errno != libc.ErrnoSuccess {
+			return "", errno
+		}
 	}
-	return name, libc.ErrnoSuccess
+	return fsys.resolveAllowed(op, dir, name, follow)
 }
 
 func (fsys *filesystem) readlink(fd int32, name string) (string, libc.Errno) {
 	if fsys.fs == nil {
 		return "", libc.ErrnoNosys
 	}
-	name, errno := fsys.rel(fd, name)
+	name, errno := fsys.rel(OpReadlink, fd, name, false)
 	if errno != libc.ErrnoSuccess {
 		return "", errno
 	}
-	info, err := hackpadfs.Stat(fsys.fs, name)
+	info, err := fsys.lstat(name)
 	if err != nil {
 		return "", libc.Error(err)
 	}
-	// TODO: is this accurate?
-	return info.Name(), libc.ErrnoSuccess
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", libc.ErrnoInval
+	}
+	return fsys.readlinkRaw(name)
 }
 
 func (fsys *filesystem) rename(fd int32, old, new string) libc.Errno {
 	if fsys.fs == nil {
 		return libc.ErrnoNosys
 	}
-	old, errno := fsys.rel(fd, old)
+	old, errno := fsys.rel(OpRename, fd, old, false)
+	if errno != libc.ErrnoSuccess {
+		return errno
+	}
+	// TODO: new should be relative to newfd
+	new, errno = fsys.rel(OpRename, fd, new, false)
 	if errno != libc.ErrnoSuccess {
 		return errno
 	}
-	// TODO: is new also relative?
-	err := hackpadfs.Rename(fsys.fs, old, new)
-	return libc.Error(err)
+	if !fsys.writable(old) || !fsys.writable(new) {
+		return libc.ErrnoRofs
+	}
+	defer fsys.lockShared(old, new)()
+	_, err := fsys.lstat(new)
+	replaced := err == nil
+	if err := hackpadfs.Rename(fsys.fs, old, new); err != nil {
+		return libc.Error(err)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.changes.rename(old, new, replaced)
+	fsys.renameIno(old, new)
+	return libc.ErrnoSuccess
 }
 
 func (fsys *filesystem) remove(fd int32, name string) libc.Errno {
 	if fsys.fs == nil {
 		return libc.ErrnoNosys
 	}
-	name, errno := fsys.rel(fd, name)
+	name, errno := fsys.rel(OpRemove, fd, name, false)
 	if errno != libc.ErrnoSuccess {
 		return errno
 	}
+	if !fsys.writable(name) {
+		return libc.ErrnoRofs
+	}
+	defer fsys.lockShared(name)()
 	err := hackpadfs.Remove(fsys.fs, name)
-	return libc.Error(err)
+	if err != nil {
+		return libc.Error(err)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.changes.delete(name)
+	fsys.removeIno(name)
+	return libc.ErrnoSuccess
 }
 
 func (fsys *filesystem) rmdir(fd int32, name string) libc.Errno {
 	if fsys.fs == nil {
 		return libc.ErrnoNosys
 	}
-	name, errno := fsys.rel(fd, name)
+	name, errno := fsys.rel(OpRemove, fd, name, false)
 	if errno != libc.ErrnoSuccess {
 		return errno
 	}
+	defer fsys.lockShared(name)()
 	stat, err := hackpadfs.Stat(fsys.fs, name)
 	if err != nil {
 		return libc.Error(err)
@@ -221,20 +476,44 @@ func (fsys *filesystem) rmdir(fd int32, name string) libc.Errno {
 	if !stat.IsDir() {
 		return libc.ErrnoNotdir
 	}
+	if !fsys.writable(name) {
+		return libc.ErrnoRofs
+	}
 	err = hackpadfs.Remove(fsys.fs, name)
-	return libc.Error(err)
+	if err != nil {
+		return libc.Error(err)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.changes.delete(name)
+	fsys.removeIno(name)
+	return libc.ErrnoSuccess
 }
 
-func (fsys *filesystem) mkdir(fd int32, name string, mode fs.FileMode) libc.Errno {
+func (fsys *filesystem) mkdir(fd int32, name string) libc.Errno {
 	if fsys.fs == nil {
 		return libc.ErrnoNosys
 	}
-	name, errno := fsys.rel(fd, name)
+	name, errno := fsys.rel(OpMkdir, fd, name, false)
 	if errno != libc.ErrnoSuccess {
 		return errno
 	}
-	err := hackpadfs.Mkdir(fsys.fs, name, mode)
-	return libc.Error(err)
+	if !fsys.writable(name) {
+		return libc.ErrnoRofs
+	}
+	if err := fsys.quota.create(); err != nil {
+		return libc.Error(err)
+	}
+	defer fsys.lockShared(name)()
+	err := hackpadfs.Mkdir(fsys.fs, name, fsys.perms.dirMode())
+	if err != nil {
+		fsys.quota.release()
+		return libc.Error(err)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.changes.create(name)
+	return libc.ErrnoSuccess
 }
 
 // func (fsys *filesystem) rmdir(name string) libc.Errno {
@@ -258,28 +537,32 @@ func (fsys *filesystem) readdir(fd libc.Int, cookie int64) (ent *libc.Dirent, na
 		return nil, "", errno
 	}
 	if f.dirent == nil {
-		info, err := f.Stat()
-		if err != nil {
-			return nil, "", libc.Error(err)
+		dirname, errno := fsys.dir(f)
+		if errno != libc.ErrnoSuccess {
+			return nil, "", errno
 		}
-		dirname := info.Name()
-		f.dirent, err = fs.ReadDir(fsys.fs, dirname)
+		ents, err := fs.ReadDir(fsys.fs, dirname)
 		if err != nil {
 			return nil, "", libc.Error(err)
 		}
+		f.dirent = ents[:0]
+		for _, ent := range ents {
+			if fsys.allow(OpStat, path.Join(dirname, ent.Name())) == libc.ErrnoSuccess {
+				f.dirent = append(f.dirent, ent)
+			}
+		}
 		i = 0
 	}
 	if i >= len(f.dirent) {
 		return nil, "", libc.ErrnoSuccess
 	}
 	name = f.dirent[i].Name()
-	dtype := libc.FiletypeRegularFile
-	if f.dirent[i].IsDir() {
-		dtype = libc.FiletypeDirectory
-	}
+	dtype := filetype(f.dirent[i].Type())
+	info, _ := f.dirent[i].Info()
+	_, ino := fsys.ino(path.Join(fsys.pathOf(f), name), info)
 	dir := &libc.Dirent{
 		Next:   uint64(i + 1),
-		Ino:    fsys.ino(fd, name),
+		Ino:    ino,
 		Namlen: libc.Size(len(name)),
 		Dtype:  dtype,
 	}
@@ -289,32 +572,45 @@ func (fsys *filesystem) readdir(fd libc.Int, cookie int64) (ent *libc.Dirent, na
 type filedesc struct {
 	fs.File
 	no      libc.Int
+	path    string // canonical path relative to the filesystem root, empty for streams
 	fdstat  *libc.Fdstat
 	preopen string
 	dirent  []fs.DirEntry
 	mode    fs.FileMode
+	quota   *quota // nil for unlimited
 
 	rc int
 }
 
 func (fd *filedesc) Write(b []byte) (int, error) {
-	if w, ok := fd.File.(io.Writer); ok {
+	w, ok := fd.File.(io.Writer)
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	if fd.fdstat.Flags&libc.FdflagAppend != 0 && fd.no > stdioMaxFD {
+		// in case the filesystem ignored O_APPEND
+		if _, err := hackpadfs.SeekFile(fd.File, 0, io.SeekEnd); err != nil && !errors.Is(err, hackpadfs.ErrNotImplemented) {
+			return 0, err
+		}
+	}
+	if fd.quota == nil {
 		return w.Write(b)
 	}
-	return 0, syscall.ENOSYS
+	return fd.quota.write(fd.File, w, b)
 }
 
-func (fd *filedesc) rel(name string) (string, libc.Errno) {
-	if fd.preopen != "" {
-		return fd.preopen + name, libc.ErrnoSuccess
+// dir returns the path of this directory, relative to the filesystem root.
+func (fd *filedesc) dir() (string, libc.Errno) {
+	if fd.fdstat.Filetype != libc.FiletypeDirectory {
+		return "", libc.ErrnoNotdir
 	}
-	stat, err := fd.File.Stat()
-	if err != nil {
-		return "", libc.Error(err)
+	if fd.path == "" {
+		return "", libc.ErrnoBadf
 	}
-	return path.Join(stat.Name(), name), libc.ErrnoSuccess
+	return fd.path, libc.ErrnoSuccess
 }
 
+// share increments fd's reference count. fsys.mu must be held.
 func (fsys *filesystem) share(fd *filedesc) {
 	if fd.no <= stdioMaxFD {
 		return
@@ -322,15 +618,36 @@ func (fsys *filesystem) share(fd *filedesc) {
 	fd.rc++
 }
 
-func (fsys *filesystem) unshare(fd *filedesc) {
+func (fsys *filesystem) unshare(fd *filedesc) libc.Errno {
 	if fd.no <= stdioMaxFD {
-		return
+		return libc.ErrnoSuccess
 	}
+	fsys.mu.Lock()
 	fd.rc--
-	if fd.rc <= 0 {
+	gc := fd.rc <= 0
+	if gc {
 		// log.Println("gc", fd.no)
 		delete(fsys.fds, fd.no)
 	}
+	fsys.mu.Unlock()
+	if gc && fd.File != nil {
+		return libc.Error(fd.File.Close())
+	}
+	return libc.ErrnoSuccess
+}
+
+// dir returns the path of the directory fd, see filedesc.dir.
+func (fsys *filesystem) dir(fd *filedesc) (string, libc.Errno) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fd.dir()
+}
+
+// pathOf returns fd's current path, which can change if it is renamed.
+func (fsys *filesystem) pathOf(fd *filedesc) string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fd.path
 }
 
 type file interface {
@@ -346,22 +663,7 @@ func newFile(f fs.File) (*filedesc, libc.Errno) {
 
 	var fdstat libc.Fdstat
 	mode := stat.Mode()
-	switch {
-	case mode.IsRegular():
-		fdstat.Filetype = libc.FiletypeRegularFile
-	case mode.IsDir():
-		fdstat.Filetype = libc.FiletypeDirectory
-	case mode&fs.ModeCharDevice != 0:
-		fdstat.Filetype = libc.FiletypeCharacterDevice
-	case mode&fs.ModeDevice != 0:
-		fdstat.Filetype = libc.FiletypeBlockDevice
-	case mode&fs.ModeSymlink != 0:
-		fdstat.Filetype = libc.FiletypeSymbolicLink
-	case mode&fs.ModeSocket != 0:
-		fdstat.Filetype = libc.FiletypeSocketStream
-	default:
-		fdstat.Filetype = libc.FiletypeUnknown
-	}
+	fdstat.Filetype = filetype(mode)
 	fdstat.RightsInheriting = uint64(mode.Perm()) // TODO: verify
 	fdstat.RightsBase = uint64(mode.Perm())       // TODO: verify
 
@@ -373,7 +675,7 @@ func newFile(f fs.File) (*filedesc, libc.Errno) {
 }
 
 func newStream(v any) *filedesc {
-	file := &stream{}
+	file := &stream{turn: make(chan struct{}, 1), quit: make(chan struct{})}
 	if x, ok := v.(io.Writer); ok {
 		file.Writer = x
 	}
@@ -409,6 +711,24 @@ type stream struct {
 	io.Seeker
 	io.Reader
 	statter
+
+	// held while reading, so that guests sharing an instance take turns
+	turn chan struct{}
+	// closed by stop, ending the reader goroutine
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// set up by readContext, after which all reads go through the reader goroutine
+	wants   chan int        // read requests, by size
+	reads   chan readResult // their results
+	waiting bool            // a request hasn't been answered yet
+	pending []byte          // data read but not yet returned
+	err     error           // error to return once pending is drained
+}
+
+type readResult struct {
+	data []byte
+	err  error
 }
 
 type statter interface {
@@ -419,7 +739,7 @@ func (s *stream) Stat() (fs.FileInfo, error) {
 	if s.statter != nil {
 		return s.statter.Stat()
 	}
-	return fileinfo{}, nil // TODO
+	return fileinfo{mode: deviceMode}, nil
 }
 
 func (s *stream) Write(p []byte) (int, error) {
@@ -437,17 +757,97 @@ func (s *stream) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (s *stream) Close() error {
+	s.stop()
 	if s.Closer == nil {
 		return nil
 	}
 	return s.Closer.Close()
 }
 
+// stop ends the reader goroutine, if any, without closing the underlying reader.
+// A read it has in progress is let finish and its data is dropped.
+// Reads that would need the goroutine fail afterwards.
+func (s *stream) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
 func (s *stream) Read(buf []byte) (int, error) {
+	return s.readContext(nil, buf)
+}
+
+// readContext reads into buf, giving up when ctx is done.
+// The reader might block forever, so once a read is given up on, reads move to a goroutine
+// that lives as long as the stream. Whatever it reads is kept for the next call.
+func (s *stream) readContext(ctx context.Context, buf []byte) (int, error) {
 	if s.Reader == nil {
 		return 0, io.EOF
 	}
-	return s.Reader.Read(buf)
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case s.turn <- struct{}{}:
+	case <-done:
+		return 0, ctx.Err()
+	}
+	defer func() { <-s.turn }()
+
+	if len(s.pending) > 0 {
+		n := copy(buf, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	if s.err != nil {
+		err := s.err
+		s.err = nil
+		return 0, err
+	}
+	select {
+	case <-s.quit:
+		return 0, fs.ErrClosed
+	default:
+	}
+	if s.wants == nil {
+		if done == nil {
+			return s.Reader.Read(buf)
+		}
+		s.wants = make(chan int, 1)
+		s.reads = make(chan readResult, 1)
+		go s.readLoop(s.wants, s.reads)
+	}
+	if !s.waiting {
+		s.wants <- len(buf)
+		s.waiting = true
+	}
+	select {
+	case res := <-s.reads:
+		s.waiting = false
+		n := copy(buf, res.data)
+		s.pending = res.data[n:]
+		if len(s.pending) > 0 {
+			s.err = res.err
+			return n, nil
+		}
+		return n, res.err
+	case <-done:
+		return 0, ctx.Err()
+	case <-s.quit:
+		return 0, fs.ErrClosed
+	}
+}
+
+func (s *stream) readLoop(wants <-chan int, reads chan<- readResult) {
+	for {
+		select {
+		case size := <-wants:
+			buf := make([]byte, size)
+			n, err := s.Reader.Read(buf)
+			reads <- readResult{data: buf[:n], err: err}
+		case <-s.quit:
+			return
+		}
+	}
 }
 
 type fileinfo struct {
@@ -485,8 +885,34 @@ func (fi fileinfo) Sys() any {
 
 func cleanPath(name string) string {
 	name = path.Clean(name)
+	if name == "/" {
+		return "."
+	}
 	if len(name) > 0 && name[0] == '/' {
 		return name[1:]
 	}
 	return name
 }
+
+// perms are the permissions given to new files.
+type perms struct {
+	file  fs.FileMode
+	dir   fs.FileMode
+	umask fs.FileMode
+}
+
+func (p perms) fileMode() fs.FileMode {
+	mode := p.file
+	if mode == 0 {
+		mode = createMode
+	}
+	return mode &^ p.umask
+}
+
+func (p perms) dirMode() fs.FileMode {
+	mode := p.dir
+	if mode == 0 {
+		mode = mkdirMode
+	}
+	return mode &^ p.umask
+}
@@ -0,0 +1,512 @@
+package hammertime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestOpenFlags(t *testing.T) {
+	const rw = libc.RightFdRead | libc.RightFdWrite
+
+	t.Run("read-only fs.FS", func(t *testing.T) {
+		wasi := NewWASI(WithFS(fstest.MapFS{
+			"dir/a.txt": &fstest.MapFile{Data: []byte("a")},
+		}))
+		if _, errno := wasi.open(rootFD, "dir", libc.LookupflagSymlinkfollow, libc.OflagDirectory, 0, libc.RightFdReaddir); errno != 0 {
+			t.Error("open dir", errno)
+		}
+		if _, errno := wasi.open(rootFD, "dir/a.txt", 0, libc.OflagDirectory, 0, libc.RightFdReaddir); errno != libc.ErrnoNotdir {
+			t.Error("bad errno. want:", libc.ErrnoNotdir, "got:", errno)
+		}
+	})
+
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wasi := NewWASI(WithFS(linkFS{FS: memfs, links: map[string]string{"link": "a.txt"}}))
+
+	if _, errno := wasi.open(rootFD, "a.txt", 0, libc.OflagCreat|libc.OflagExcl, 0, rw); errno != libc.ErrnoExist {
+		t.Error("bad O_EXCL errno. want:", libc.ErrnoExist, "got:", errno)
+	}
+	if _, errno := wasi.open(rootFD, "link", 0, 0, 0, libc.RightFdRead); errno != libc.ErrnoLoop {
+		t.Error("bad O_NOFOLLOW errno. want:", libc.ErrnoLoop, "got:", errno)
+	}
+	if _, errno := wasi.open(rootFD, "link", libc.LookupflagSymlinkfollow, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("open symlink", errno)
+	}
+
+	fd, errno := wasi.open(rootFD, "a.txt", 0, 0, libc.FdflagAppend, rw)
+	if errno != 0 {
+		t.Fatal("open append", errno)
+	}
+	f, _ := wasi.get(fd)
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	wasi.close(fd)
+	data, _ := hackpadfs.ReadFile(memfs, "a.txt")
+	if string(data) != "hello world" {
+		t.Error("bad append. want: hello world got:", string(data))
+	}
+
+	fd, errno = wasi.open(rootFD, "a.txt", 0, libc.OflagTrunc, 0, rw)
+	if errno != 0 {
+		t.Fatal("open trunc", errno)
+	}
+	f, _ = wasi.get(fd)
+	f.Write([]byte("bye"))
+	hackpadfs.SeekFile(f.File, 0, io.SeekStart)
+	data, err = io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye" {
+		t.Error("bad read-write. want: bye got:", string(data))
+	}
+}
+
+func TestNestedPaths(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memfs.MkdirAll("subdir/inner", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "subdir/inner/x.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// same base name at the root, to catch lookups by name
+	if err := memfs.Mkdir("inner", 0755); err != nil {
+		t.Fatal(err)
+	}
+	wasi := NewWASI(WithFS(memfs))
+
+	subdir, errno := wasi.open(rootFD, "subdir", libc.LookupflagSymlinkfollow, libc.OflagDirectory, 0, libc.RightFdReaddir)
+	if errno != 0 {
+		t.Fatal("open subdir", errno)
+	}
+	inner, errno := wasi.open(subdir, "inner", libc.LookupflagSymlinkfollow, libc.OflagDirectory, 0, libc.RightFdReaddir)
+	if errno != 0 {
+		t.Fatal("open inner", errno)
+	}
+	if _, errno := wasi.open(inner, "x.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("openat x.txt", errno)
+	}
+	if _, errno := wasi.open(inner, "../../inner", 0, libc.OflagDirectory, 0, libc.RightFdReaddir); errno != 0 {
+		t.Error("openat ../../inner", errno)
+	}
+	_, name, errno := wasi.readdir(inner, 0)
+	if errno != 0 || name != "x.txt" {
+		t.Error("bad readdir. want: x.txt got:", name, errno)
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memfs.MkdirAll("home/user", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "home/user/x.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wasi := NewWASI(WithFS(memfs), WithWorkingDir("/home/user"))
+
+	cwd := wasi.cwd
+	if cwd == nil || cwd.preopen != "." || cwd.no != rootFD+1 {
+		t.Fatal("working directory not preopened:", cwd)
+	}
+	if _, errno := wasi.open(cwd.no, "x.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("open relative x.txt", errno)
+	}
+	if got := wasi.Getwd(); got != "/home/user" {
+		t.Error("bad getwd. want: /home/user got:", got)
+	}
+
+	cases := []struct {
+		dir   string
+		errno libc.Errno
+		want  string
+	}{
+		{"x.txt", libc.ErrnoNotdir, "/home/user"},
+		{"nope", libc.ErrnoNoent, "/home/user"},
+		{"..", 0, "/home"},
+		{"../..", libc.ErrnoNotcapable, "/home"},
+		{"/", 0, "/"},
+		{"home/user", 0, "/home/user"},
+	}
+	for _, tc := range cases {
+		if errno := wasi.chdir(tc.dir); errno != tc.errno {
+			t.Errorf("chdir(%q): bad errno. want: %d got: %d", tc.dir, tc.errno, errno)
+		}
+		if got := wasi.Getwd(); got != tc.want {
+			t.Errorf("chdir(%q): bad getwd. want: %s got: %s", tc.dir, tc.want, got)
+		}
+	}
+	if _, errno := wasi.open(cwd.no, "x.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("open relative x.txt after chdir", errno)
+	}
+
+	// the initial working directory must be an existing directory too
+	for _, dir := range []string{"/home/user/x.txt", "/nope"} {
+		if err := NewWASI(WithFS(memfs), WithWorkingDir(dir)).err; err == nil {
+			t.Errorf("WithWorkingDir(%q): want error", dir)
+		}
+		if _, _, err := wasi.NewContext(context.Background(), WithWorkingDir(dir)); err == nil {
+			t.Errorf("NewContext with WithWorkingDir(%q): want error", dir)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const rw = libc.RightFdRead | libc.RightFdWrite
+
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wasi := NewWASI(WithFS(memfs), WithLimits(Limits{MaxBytes: 8, MaxFileSize: 5, MaxFiles: 2}))
+
+	fd, errno := wasi.open(rootFD, "a.txt", 0, libc.OflagCreat, 0, rw)
+	if errno != 0 {
+		t.Fatal("open a.txt", errno)
+	}
+	f, _ := wasi.get(fd)
+	if n, err := f.Write([]byte("hello world")); n != 5 || err != nil {
+		t.Error("bad short write. want: 5 <nil> got:", n, err)
+	}
+	if _, err := f.Write([]byte("!")); libc.Error(err) != libc.ErrnoFbig {
+		t.Error("bad errno. want:", libc.ErrnoFbig, "got:", err)
+	}
+	wasi.close(fd)
+
+	if errno := wasi.mkdir(rootFD, "dir"); errno != 0 {
+		t.Fatal("mkdir", errno)
+	}
+	if _, errno := wasi.open(rootFD, "b.txt", 0, libc.OflagCreat, 0, rw); errno != libc.ErrnoDquot {
+		t.Error("bad errno. want:", libc.ErrnoDquot, "got:", errno)
+	}
+
+	fd, errno = wasi.open(rootFD, "a.txt", 0, libc.OflagTrunc, 0, rw)
+	if errno != 0 {
+		t.Fatal("open a.txt", errno)
+	}
+	f, _ = wasi.get(fd)
+	if n, err := f.Write([]byte("12345")); n != 3 || err != nil {
+		t.Error("bad short write. want: 3 <nil> got:", n, err)
+	}
+	if _, err := f.Write([]byte("!")); libc.Error(err) != libc.ErrnoNospc {
+		t.Error("bad errno. want:", libc.ErrnoNospc, "got:", err)
+	}
+	wasi.close(fd)
+
+	want := Usage{BytesWritten: 8, FilesCreated: 2}
+	if got := wasi.Usage(); got != want {
+		t.Errorf("bad usage. want: %+v got: %+v", want, got)
+	}
+
+	// without Seek, appends are limited by the file's size
+	wasi = NewWASI(WithFS(noSeekFS{memfs}), WithLimits(Limits{MaxFileSize: 5}))
+	fd, errno = wasi.open(rootFD, "a.txt", 0, 0, libc.FdflagAppend, rw)
+	if errno != 0 {
+		t.Fatal("open a.txt", errno)
+	}
+	f, _ = wasi.get(fd)
+	if n, err := f.Write([]byte("4567")); n != 2 || err != nil {
+		t.Error("bad short write. want: 2 <nil> got:", n, err)
+	}
+	if _, err := f.Write([]byte("!")); libc.Error(err) != libc.ErrnoFbig {
+		t.Error("bad errno. want:", libc.ErrnoFbig, "got:", err)
+	}
+	wasi.close(fd)
+	if data, err := hackpadfs.ReadFile(memfs, "a.txt"); string(data) != "12345" {
+		t.Errorf("bad a.txt. want: %q got: %q %v", "12345", data, err)
+	}
+}
+
+// noSeekFS opens files that can't seek.
+type noSeekFS struct {
+	*mem.FS
+}
+
+func (fsys noSeekFS) OpenFile(name string, flag int, perm fs.FileMode) (hackpadfs.File, error) {
+	f, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return noSeekFile{f}, nil
+}
+
+type noSeekFile struct {
+	hackpadfs.File
+}
+
+func (f noSeekFile) Write(p []byte) (int, error) {
+	return hackpadfs.WriteFile(f.File, p)
+}
+
+func TestCreateMode(t *testing.T) {
+	cases := []struct {
+		opts []Option
+		file fs.FileMode
+		dir  fs.FileMode
+	}{
+		{nil, 0644, 0755},
+		{[]Option{WithUmask(0077)}, 0600, 0700},
+		{[]Option{WithCreateMode(0666, 0777), WithUmask(0002)}, 0664, 0775},
+	}
+	for _, tc := range cases {
+		memfs, err := mem.NewFS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wasi := NewWASI(append(tc.opts, WithFS(memfs))...)
+		fd, errno := wasi.open(rootFD, "a.txt", 0, libc.OflagCreat, 0, libc.RightFdWrite)
+		if errno != 0 {
+			t.Fatal("open a.txt", errno)
+		}
+		wasi.close(fd)
+		if errno := wasi.mkdir(rootFD, "dir"); errno != 0 {
+			t.Fatal("mkdir", errno)
+		}
+		if info, _ := memfs.Stat("a.txt"); info.Mode().Perm() != tc.file {
+			t.Errorf("bad file mode. want: %v got: %v", tc.file, info.Mode().Perm())
+		}
+		if info, _ := memfs.Stat("dir"); info.Mode().Perm() != tc.dir {
+			t.Errorf("bad dir mode. want: %v got: %v", tc.dir, info.Mode().Perm())
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro := fstest.MapFS{
+		"a.txt":     &fstest.MapFile{Data: []byte("a")},
+		"dir/b.txt": &fstest.MapFile{Data: []byte("b")},
+	}
+	wasi := NewWASI(WithFS(memfs), WithMount("/ro", ro))
+
+	if _, errno := wasi.open(rootFD, "/ro/a.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("open read-only", errno)
+	}
+	if _, errno := wasi.open(rootFD, "/ro/new.txt", 0, libc.OflagCreat, 0, libc.RightFdWrite); errno != libc.ErrnoRofs {
+		t.Error("bad create errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if _, errno := wasi.open(rootFD, "/ro/a.txt", 0, libc.OflagTrunc, 0, libc.RightFdWrite); errno != libc.ErrnoRofs {
+		t.Error("bad truncate errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if errno := wasi.mkdir(rootFD, "/ro/new"); errno != libc.ErrnoRofs {
+		t.Error("bad mkdir errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if errno := wasi.remove(rootFD, "/ro/a.txt"); errno != libc.ErrnoRofs {
+		t.Error("bad unlink errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if errno := wasi.rmdir(rootFD, "/ro/dir"); errno != libc.ErrnoRofs {
+		t.Error("bad rmdir errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if errno := wasi.rename(rootFD, "/ro/a.txt", "/ro/c.txt"); errno != libc.ErrnoRofs {
+		t.Error("bad rename errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if errno := wasi.mkdir(rootFD, "/rw"); errno != 0 {
+		t.Error("mkdir outside of read-only mount", errno)
+	}
+
+	// files from a read-only wrapper might still support truncating
+	backing, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(backing, "t.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wasi = NewWASI(WithFS(memfs), WithMount("/rom", readOnly{backing}))
+	if _, errno := wasi.open(rootFD, "/rom/t.txt", 0, libc.OflagTrunc, 0, 0); errno != libc.ErrnoRofs {
+		t.Error("bad truncate without rights errno. want:", libc.ErrnoRofs, "got:", errno)
+	}
+	if data, err := fs.ReadFile(backing, "t.txt"); err != nil || string(data) != "data" {
+		t.Error("read-only file truncated:", string(data), err)
+	}
+}
+
+func TestSharedFS(t *testing.T) {
+	const n = 16
+	const rw = libc.RightFdRead | libc.RightFdWrite
+
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewWASI(WithFS(memfs))
+
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wasi := NewWASI(WithFS(memfs))
+			if fd, errno := wasi.open(rootFD, "lock", 0, libc.OflagCreat|libc.OflagExcl, 0, rw); errno == 0 {
+				created.Add(1)
+				wasi.close(fd)
+			} else if errno != libc.ErrnoExist {
+				t.Error("bad O_EXCL errno. want:", libc.ErrnoExist, "got:", errno)
+			}
+
+			// and one instance used from many goroutines
+			fd, errno := shared.open(rootFD, fmt.Sprintf("file%d", i), 0, libc.OflagCreat, 0, rw)
+			if errno != 0 {
+				t.Error("open", errno)
+				return
+			}
+			if _, errno := shared.stat(fd); errno != 0 {
+				t.Error("stat", errno)
+			}
+			if errno := shared.close(fd); errno != 0 {
+				t.Error("close", errno)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := created.Load(); got != 1 {
+		t.Error("O_EXCL not atomic. want: 1 created got:", got)
+	}
+	changes, err := shared.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != n {
+		t.Error("bad changes. want:", n, "got:", len(changes))
+	}
+
+	// nested host directories overlap, so they share a lock
+	dir := t.TempDir()
+	a := NewWASI(WithHostDir("/a", dir, DirReadWrite)).backing("a/x")
+	b := NewWASI(WithHostDir("/b", filepath.Join(dir, "sub"), DirReadWrite)).backing("b/x")
+	if _, ok := a.(*hostfs); !ok || stripe(a) != stripe(b) {
+		t.Errorf("host directories should share a lock. got: %T %d, %T %d", a, stripe(a), b, stripe(b))
+	}
+	// others are spread out by their cleaned top-level directory
+	if _, top, err := hostDir("/usr/lib/../../srv/data"); err != nil || !strings.HasSuffix(top, "/srv") {
+		t.Error("bad top-level directory. want: /srv got:", top, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memfs.MkdirAll("config/secrets", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config/app.yaml", "config/app.json", "config/secrets/key.yaml"} {
+		if err := hackpadfs.WriteFullFile(memfs, name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := GlobPolicy([]string{"/config/*.yaml", "/tmp"}, []string{"/config/secrets"})
+	var ops []string
+	wasi := NewWASI(WithFS(linkFS{FS: memfs, links: map[string]string{"sneaky": "config/secrets/key.yaml"}}), WithPolicy(func(op Op, path string) error {
+		ops = append(ops, op.String()+" "+path)
+		if op == OpRemove {
+			return fmt.Errorf("nope: %w", ErrNotCapable)
+		}
+		return policy(op, path)
+	}))
+
+	cases := []struct {
+		path  string
+		oflag libc.Oflag
+		errno libc.Errno
+	}{
+		{"config/app.yaml", 0, 0},
+		{"config/app.json", 0, libc.ErrnoAcces},
+		{"config/secrets/key.yaml", 0, libc.ErrnoAcces},
+		{"config/../config/secrets/key.yaml", 0, libc.ErrnoAcces},
+		{"sneaky", 0, libc.ErrnoAcces},
+		// denied before looking anything up, so this isn't ENOENT
+		{"config/secrets/nope/x.yaml", 0, libc.ErrnoAcces},
+		{"config/new.yaml", libc.OflagCreat, 0},
+		{"tmp/x", libc.OflagCreat, libc.ErrnoNoent},
+	}
+	for _, tc := range cases {
+		if _, errno := wasi.open(rootFD, tc.path, libc.LookupflagSymlinkfollow, tc.oflag, 0, libc.RightFdRead); errno != tc.errno {
+			t.Errorf("open(%q): bad errno. want: %d got: %d", tc.path, tc.errno, errno)
+		}
+	}
+	if errno := wasi.mkdir(rootFD, "tmp"); errno != 0 {
+		t.Error("mkdir allowed", errno)
+	}
+	if errno := wasi.mkdir(rootFD, "other"); errno != libc.ErrnoAcces {
+		t.Error("bad mkdir errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	if errno := wasi.rename(rootFD, "config/app.yaml", "config/secrets/app.yaml"); errno != libc.ErrnoAcces {
+		t.Error("bad rename errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	if errno := wasi.rename(rootFD, "config/secrets/nope/a.yaml", "config/b.yaml"); errno != libc.ErrnoAcces {
+		t.Error("bad rename errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	if errno := wasi.remove(rootFD, "config/app.yaml"); errno != libc.ErrnoNotcapable {
+		t.Error("bad unlink errno. want:", libc.ErrnoNotcapable, "got:", errno)
+	}
+	if errno := wasi.remove(rootFD, "config/secrets/nope/a.yaml"); errno != libc.ErrnoNotcapable {
+		t.Error("bad unlink errno. want:", libc.ErrnoNotcapable, "got:", errno)
+	}
+	if _, errno := wasi.readlink(rootFD, "sneaky"); errno != libc.ErrnoAcces {
+		t.Error("bad readlink errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	if _, errno := wasi.statAt(rootFD, "config/app.yaml", true); errno != 0 {
+		t.Error("stat allowed", errno)
+	}
+	if _, errno := wasi.statAt(rootFD, "sneaky", true); errno != libc.ErrnoAcces {
+		t.Error("bad stat errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	// entries the policy denies are left out of listings
+	var names []string
+	for cookie := int64(0); ; cookie++ {
+		_, name, errno := wasi.readdir(rootFD, cookie)
+		if errno != 0 {
+			t.Fatal("readdir", errno)
+		}
+		if name == "" {
+			break
+		}
+		names = append(names, name)
+	}
+	if len(names) != 1 || names[0] != "tmp" {
+		t.Error("bad root listing. want: [tmp] got:", names)
+	}
+	if errno := wasi.chdir("config/secrets"); errno != libc.ErrnoAcces {
+		t.Error("bad chdir errno. want:", libc.ErrnoAcces, "got:", errno)
+	}
+	if errno := wasi.chdir("tmp"); errno != 0 || wasi.Getwd() != "/tmp" {
+		t.Error("chdir allowed", errno, wasi.Getwd())
+	}
+	if want := "read /config/app.yaml"; len(ops) == 0 || ops[0] != want {
+		t.Errorf("bad policy ops. want first: %q got: %q", want, ops)
+	}
+}
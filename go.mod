@@ -8,3 +8,5 @@ require (
 )
 
 require github.com/hack-pad/hackpadfs v0.2.1
+
+require github.com/tetratelabs/wazero v1.1.0
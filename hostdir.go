@@ -0,0 +1,246 @@
+package hammertime
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	hpos "github.com/hack-pad/hackpadfs/os"
+)
+
+// DirMode controls what the guest is allowed to do with a host directory.
+type DirMode int
+
+const (
+	// DirReadOnly forbids all changes. Mutations fail with EROFS.
+	DirReadOnly DirMode = iota
+	// DirReadWrite allows any changes.
+	DirReadWrite
+	// DirCreateOnly allows creating new files and directories,
+	// but not modifying, renaming, or removing files that the guest didn't create.
+	DirCreateOnly
+)
+
+// WithHostDir mounts the host directory hostPath at guestPath, like wasmtime's --dir host::guest.
+// hostPath can be absolute or relative to the current working directory.
+// Mounting at "/" replaces the filesystem given by WithFS.
+func WithHostDir(guestPath, hostPath string, mode DirMode) Option {
+	return func(wasi *WASI) {
+		wasi.mounts = append(wasi.mounts, mountpoint{path: guestPath, fs: newHostFS(hostPath, mode)})
+	}
+}
+
+// hostfs is a host OS directory with access restrictions.
+type hostfs struct {
+	host    *hpos.FS
+	top     string // top-level host directory containing it, for locking
+	mode    DirMode
+	err     error               // error setting up the FS, if any
+	created map[string]struct{} // for DirCreateOnly
+
+	mu sync.Mutex // guards created, as instances may share a hostfs
+}
+
+func newHostFS(hostPath string, mode DirMode) *hostfs {
+	hfs := &hostfs{
+		mode:    mode,
+		created: make(map[string]struct{}),
+	}
+	hfs.host, hfs.top, hfs.err = hostDir(hostPath)
+	return hfs
+}
+
+func hostDir(hostPath string) (fsys *hpos.FS, top string, err error) {
+	abs, err := filepath.Abs(hostPath)
+	if err != nil {
+		return nil, "", err
+	}
+	var base hackpadfs.FS = hpos.NewFS()
+	vol := filepath.VolumeName(abs)
+	if vol != "" {
+		base, err = hpos.NewFS().SubVolume(vol)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	dir := strings.TrimPrefix(filepath.ToSlash(abs[len(vol):]), "/")
+	first, _, _ := strings.Cut(dir, "/")
+	top = vol + "/" + first
+	if dir == "" {
+		dir = "."
+	}
+	base, err = hackpadfs.Sub(base, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return base.(*hpos.FS), top, nil
+}
+
+// check reports whether the given operation is allowed.
+// create is true if the operation makes a new file.
+func (hfs *hostfs) check(op, name string, create bool) error {
+	if hfs.err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: hfs.err}
+	}
+	switch hfs.mode {
+	case DirReadWrite:
+		return nil
+	case DirCreateOnly:
+		if create || hfs.wasCreated(name) {
+			return nil
+		}
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (hfs *hostfs) wasCreated(name string) bool {
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	_, ok := hfs.created[name]
+	return ok
+}
+
+func (hfs *hostfs) markCreated(name string) {
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	hfs.created[name] = struct{}{}
+}
+
+func (hfs *hostfs) Open(name string) (fs.File, error) {
+	if hfs.err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: hfs.err}
+	}
+	return hfs.host.Open(name)
+}
+
+func (hfs *hostfs) OpenFile(name string, flag int, perm fs.FileMode) (hackpadfs.File, error) {
+	if flag&(hackpadfs.FlagWriteOnly|hackpadfs.FlagReadWrite|hackpadfs.FlagCreate|hackpadfs.FlagTruncate|hackpadfs.FlagAppend) == 0 {
+		return hfs.Open(name)
+	}
+	create := false
+	if flag&hackpadfs.FlagCreate != 0 && hfs.mode == DirCreateOnly {
+		_, err := hfs.Lstat(name)
+		create = err != nil
+		if create {
+			// make sure we don't clobber anything
+			flag |= hackpadfs.FlagExclusive
+		}
+	}
+	if err := hfs.check("open", name, create); err != nil {
+		return nil, err
+	}
+	f, err := hfs.host.OpenFile(name, flag, perm)
+	if err == nil && create {
+		hfs.markCreated(name)
+	}
+	return f, err
+}
+
+func (hfs *hostfs) Mkdir(name string, perm fs.FileMode) error {
+	if err := hfs.check("mkdir", name, true); err != nil {
+		return err
+	}
+	err := hfs.host.Mkdir(name, perm)
+	if err == nil {
+		hfs.markCreated(name)
+	}
+	return err
+}
+
+func (hfs *hostfs) Remove(name string) error {
+	if err := hfs.check("remove", name, false); err != nil {
+		return err
+	}
+	err := hfs.host.Remove(name)
+	if err == nil {
+		hfs.mu.Lock()
+		delete(hfs.created, name)
+		hfs.mu.Unlock()
+	}
+	return err
+}
+
+func (hfs *hostfs) Rename(oldname, newname string) error {
+	if err := hfs.check("rename", oldname, false); err != nil {
+		return err
+	}
+	if hfs.mode == DirCreateOnly {
+		if _, err := hfs.Lstat(newname); err == nil {
+			if err := hfs.check("rename", newname, false); err != nil {
+				return err
+			}
+		}
+	}
+	err := hfs.host.Rename(oldname, newname)
+	if err == nil {
+		hfs.mu.Lock()
+		if _, ok := hfs.created[oldname]; ok {
+			delete(hfs.created, oldname)
+			hfs.created[newname] = struct{}{}
+		}
+		hfs.mu.Unlock()
+	}
+	return err
+}
+
+func (hfs *hostfs) Chmod(name string, mode fs.FileMode) error {
+	if err := hfs.check("chmod", name, false); err != nil {
+		return err
+	}
+	return hfs.host.Chmod(name, mode)
+}
+
+func (hfs *hostfs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := hfs.check("chtimes", name, false); err != nil {
+		return err
+	}
+	return hfs.host.Chtimes(name, atime, mtime)
+}
+
+func (hfs *hostfs) Stat(name string) (fs.FileInfo, error) {
+	if hfs.err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: hfs.err}
+	}
+	return hfs.host.Stat(name)
+}
+
+func (hfs *hostfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if hfs.err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: hfs.err}
+	}
+	return hfs.host.ReadDir(name)
+}
+
+// Lstat implements ReadLinkFS.
+func (hfs *hostfs) Lstat(name string) (fs.FileInfo, error) {
+	if hfs.err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: hfs.err}
+	}
+	return hfs.host.Lstat(name)
+}
+
+// ReadLink implements ReadLinkFS.
+func (hfs *hostfs) ReadLink(name string) (string, error) {
+	if hfs.err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: hfs.err}
+	}
+	osPath, err := hfs.host.ToOSPath(name)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(osPath)
+	if pe, ok := err.(*fs.PathError); ok {
+		// don't leak host paths
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: pe.Err}
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(target), nil
+}
@@ -0,0 +1,74 @@
+package hammertime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestHostDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(dir, "root")); err != nil {
+		t.Fatal(err)
+	}
+
+	const rw = libc.RightFdRead | libc.RightFdWrite
+	t.Run("read-only", func(t *testing.T) {
+		wasi := NewWASI(WithHostDir("/host", dir, DirReadOnly))
+		if _, errno := wasi.open(rootFD, "/host/existing.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+			t.Error("open", errno)
+		}
+		if _, errno := wasi.open(rootFD, "/host/existing.txt", 0, 0, 0, rw); errno != libc.ErrnoRofs {
+			t.Error("bad open errno. want:", libc.ErrnoRofs, "got:", errno)
+		}
+		if errno := wasi.mkdir(rootFD, "/host/new"); errno != libc.ErrnoRofs {
+			t.Error("bad mkdir errno. want:", libc.ErrnoRofs, "got:", errno)
+		}
+		if errno := wasi.remove(rootFD, "/host/existing.txt"); errno != libc.ErrnoRofs {
+			t.Error("bad remove errno. want:", libc.ErrnoRofs, "got:", errno)
+		}
+		// absolute symlinks stay inside the mount
+		if path, errno := wasi.rel(OpStat, rootFD, "/host/root/host/existing.txt", true); errno != 0 || path != "host/existing.txt" {
+			t.Error("bad symlink resolution:", path, errno)
+		}
+	})
+
+	t.Run("read-write", func(t *testing.T) {
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(wd, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wasi := NewWASI(WithHostDir("/", rel, DirReadWrite))
+		if errno := wasi.mkdir(rootFD, "/rw"); errno != 0 {
+			t.Error("mkdir", errno)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "rw")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("create-only", func(t *testing.T) {
+		wasi := NewWASI(WithHostDir("/host", dir, DirCreateOnly))
+		if _, errno := wasi.open(rootFD, "/host/existing.txt", 0, libc.OflagTrunc, 0, rw); errno != libc.ErrnoPerm {
+			t.Error("bad open errno. want:", libc.ErrnoPerm, "got:", errno)
+		}
+		if _, errno := wasi.open(rootFD, "/host/created.txt", 0, libc.OflagCreat, 0, rw); errno != 0 {
+			t.Error("create", errno)
+		}
+		if _, errno := wasi.open(rootFD, "/host/created.txt", 0, libc.OflagTrunc, 0, rw); errno != 0 {
+			t.Error("reopen", errno)
+		}
+		if errno := wasi.remove(rootFD, "/host/existing.txt"); errno != libc.ErrnoPerm {
+			t.Error("bad remove errno. want:", libc.ErrnoPerm, "got:", errno)
+		}
+	})
+}
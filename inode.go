@@ -0,0 +1,118 @@
+package hammertime
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// inodeTable assigns stable inode numbers to paths, for filesystems that don't have their own.
+// Inodes follow files when they are renamed.
+type inodeTable struct {
+	dev   uint64
+	next  uint64
+	paths map[string]uint64
+}
+
+func newInodeTable(dev uint64) *inodeTable {
+	return &inodeTable{
+		dev:   dev,
+		next:  1,
+		paths: make(map[string]uint64),
+	}
+}
+
+func (t *inodeTable) get(name string) uint64 {
+	if ino, ok := t.paths[name]; ok {
+		return ino
+	}
+	ino := t.next
+	t.next++
+	t.paths[name] = ino
+	return ino
+}
+
+func (t *inodeTable) rename(old, new string) {
+	prefix := old + "/"
+	for k, ino := range t.paths {
+		if strings.HasPrefix(k, prefix) {
+			delete(t.paths, k)
+			t.paths[new+"/"+k[len(prefix):]] = ino
+		}
+	}
+	delete(t.paths, new)
+	if ino, ok := t.paths[old]; ok {
+		delete(t.paths, old)
+		t.paths[new] = ino
+	}
+}
+
+func (t *inodeTable) remove(name string) {
+	prefix := name + "/"
+	for k := range t.paths {
+		if strings.HasPrefix(k, prefix) {
+			delete(t.paths, k)
+		}
+	}
+	delete(t.paths, name)
+}
+
+// syntheticDev is set on device numbers made up by hammertime, to avoid clashing with the host's.
+const syntheticDev = 1 << 63
+
+// mountOf returns the mount point containing name, and name's path inside of it.
+func (fsys *filesystem) mountOf(name string) (point, sub string) {
+	if m, ok := fsys.fs.(*mountfs); ok {
+		_, point, sub = m.mountPoint(name)
+		return point, sub
+	}
+	return ".", name
+}
+
+func (fsys *filesystem) inodeTable(point string) *inodeTable {
+	if fsys.inodes == nil {
+		fsys.inodes = make(map[string]*inodeTable)
+	}
+	table, ok := fsys.inodes[point]
+	if !ok {
+		table = newInodeTable(syntheticDev | uint64(len(fsys.inodes)+1))
+		fsys.inodes[point] = table
+	}
+	return table
+}
+
+// ino returns the device and inode numbers for the file at name (relative to the root).
+// The host's numbers are used if info has them, otherwise they are assigned per mount.
+func (fsys *filesystem) ino(name string, info fs.FileInfo) (dev, ino uint64) {
+	if dev, ino, ok := hostIno(info); ok {
+		return dev, ino
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	point, sub := fsys.mountOf(name)
+	table := fsys.inodeTable(point)
+	return table.dev, table.get(sub)
+}
+
+// renameIno moves name's inode number (and open fds) to new. fsys.mu must be held.
+func (fsys *filesystem) renameIno(old, new string) {
+	// open files follow the rename too
+	for _, f := range fsys.fds {
+		if f.path == old || strings.HasPrefix(f.path, old+"/") {
+			f.path = new + f.path[len(old):]
+		}
+	}
+
+	oldpoint, oldsub := fsys.mountOf(old)
+	newpoint, newsub := fsys.mountOf(new)
+	if oldpoint != newpoint {
+		fsys.removeIno(old)
+		return
+	}
+	fsys.inodeTable(oldpoint).rename(oldsub, newsub)
+}
+
+// removeIno forgets name's inode number. fsys.mu must be held.
+func (fsys *filesystem) removeIno(name string) {
+	point, sub := fsys.mountOf(name)
+	fsys.inodeTable(point).remove(sub)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package hammertime
+
+import "io/fs"
+
+func hostIno(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,72 @@
+package hammertime
+
+import (
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestInodes(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"x", "y"} {
+		if err := memfs.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := hackpadfs.WriteFullFile(memfs, dir+"/a.txt", []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wasi := NewWASI(WithFS(memfs))
+
+	xa, errno := wasi.statAt(rootFD, "x/a.txt", true)
+	if errno != 0 {
+		t.Fatal("stat", errno)
+	}
+	ya, errno := wasi.statAt(rootFD, "y/a.txt", true)
+	if errno != 0 {
+		t.Fatal("stat", errno)
+	}
+	if xa.Ino == ya.Ino {
+		t.Error("same inode for different files:", xa.Ino)
+	}
+
+	fd, errno := wasi.open(rootFD, "x/a.txt", 0, 0, 0, libc.RightFdRead)
+	if errno != 0 {
+		t.Fatal("open", errno)
+	}
+	if errno := wasi.rename(rootFD, "x/a.txt", "x/b.txt"); errno != 0 {
+		t.Fatal("rename", errno)
+	}
+	renamed, errno := wasi.statAt(rootFD, "x/b.txt", true)
+	if errno != 0 {
+		t.Fatal("stat", errno)
+	}
+	if renamed.Ino != xa.Ino || renamed.Dev != xa.Dev {
+		t.Error("inode changed after rename. want:", xa.Ino, "got:", renamed.Ino)
+	}
+	fdstat, errno := wasi.stat(fd)
+	if errno != 0 {
+		t.Fatal("fstat", errno)
+	}
+	if fdstat.Ino != xa.Ino {
+		t.Error("fd_filestat_get disagrees. want:", xa.Ino, "got:", fdstat.Ino)
+	}
+
+	dirfd, errno := wasi.open(rootFD, "x", 0, libc.OflagDirectory, 0, libc.RightFdReaddir)
+	if errno != 0 {
+		t.Fatal("open dir", errno)
+	}
+	ent, name, errno := wasi.readdir(dirfd, 0)
+	if errno != 0 || name != "b.txt" {
+		t.Fatal("readdir", name, errno)
+	}
+	if ent.Ino != xa.Ino {
+		t.Error("fd_readdir disagrees. want:", xa.Ino, "got:", ent.Ino)
+	}
+}
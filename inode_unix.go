@@ -0,0 +1,19 @@
+//go:build unix
+
+package hammertime
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func hostIno(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	if info == nil {
+		return 0, 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
@@ -0,0 +1,114 @@
+package hammertime
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// Instance is the state of a single guest instance: its open files, working directory, exit status, and so on.
+// Instances of the same WASI share its configuration, but never each other's file descriptors.
+type Instance struct {
+	*config
+	filesystem
+
+	owner  *WASI
+	key    uintptr // store context this instance is registered to, if any
+	store  any     // the store itself, kept alive so that its context can't be reused by another store
+	exited bool
+	code   libc.Int
+	ctx    context.Context // of the running Call
+
+	initialized bool // _initialize has been called
+}
+
+// newInstance sets up a fresh instance. If that fails, the instance is returned anyway, along with the error.
+func (wasi *WASI) newInstance(cfg *config) (*Instance, error) {
+	inst := &Instance{
+		config: cfg,
+		owner:  wasi,
+	}
+	inst.filesystem.init(cfg.root, cfg.stdin, cfg.stdout, cfg.stderr)
+	inst.quota.Limits = cfg.limits
+	inst.filesystem.perms = cfg.modes
+	inst.filesystem.policy = cfg.policy
+	if cfg.devices {
+		inst.mount("/dev", &devfs{fsys: &inst.filesystem, random: cfg.random})
+	}
+	for _, mp := range cfg.mounts {
+		inst.mount(mp.path, mp.fs)
+	}
+	if cfg.workdir != "" {
+		if errno := inst.preopenWorkdir(cfg.workdir); errno != libc.ErrnoSuccess {
+			return inst, fmt.Errorf("hammertime: can't use %q as the working directory (errno %d)", cfg.workdir, errno)
+		}
+	}
+	return inst, nil
+}
+
+// override returns the WASI's configuration with opts applied, leaving the original alone.
+func (wasi *WASI) override(opts []Option) *config {
+	if len(opts) == 0 {
+		return &wasi.config
+	}
+	tmp := &WASI{config: wasi.config}
+	tmp.env = maps.Clone(wasi.env)
+	tmp.mounts = slices.Clip(wasi.mounts)
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	tmp.setup()
+	return &tmp.config
+}
+
+// register makes inst the instance for the given store, identified by key, instead of any store it had before.
+// The store is kept alive until inst is closed.
+func (wasi *WASI) register(key uintptr, store any, inst *Instance) {
+	if inst.store != nil {
+		wasi.instances.CompareAndDelete(inst.key, inst)
+	}
+	inst.key, inst.store = key, store
+	wasi.instances.Store(key, inst)
+}
+
+// Close closes the instance's open files and unregisters it from its store, letting the store be garbage collected.
+// Standard input and output are left open, but the goroutine left reading stdin by a cancelled call is stopped.
+func (wasi *Instance) Close() error {
+	wasi.owner.instances.CompareAndDelete(wasi.key, wasi)
+	wasi.store = nil
+
+	wasi.filesystem.mu.Lock()
+	var files []*filedesc
+	for no, f := range wasi.fds {
+		if no > stdioMaxFD {
+			files = append(files, f)
+			delete(wasi.fds, no)
+		} else if s, ok := f.File.(*stream); ok {
+			// stdio belongs to the caller, but its reader goroutine is ours
+			s.stop()
+		}
+	}
+	wasi.filesystem.mu.Unlock()
+
+	var err error
+	for _, f := range files {
+		if f.File == nil {
+			continue
+		}
+		if cerr := f.File.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ExitCode returns the code given to proc_exit, and whether the guest has called it.
+func (wasi *Instance) ExitCode() (code int, exited bool) {
+	wasi.filesystem.mu.Lock()
+	defer wasi.filesystem.mu.Unlock()
+	return int(wasi.code), wasi.exited
+}
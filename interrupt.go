@@ -0,0 +1,78 @@
+package hammertime
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// callContext returns the context of the call the guest is running in, or nil if there's none.
+func (wasi *Instance) callContext(caller guest) context.Context {
+	if ctx := caller.context(); ctx != nil {
+		return ctx
+	}
+	return wasi.ctx
+}
+
+// interrupted returns a trap if the running call's context is done.
+func (wasi *Instance) interrupted(caller guest) *trap {
+	ctx := wasi.callContext(caller)
+	if ctx == nil || ctx.Err() == nil {
+		return nil
+	}
+	return newTrap("interrupted: " + ctx.Err().Error())
+}
+
+// poll implements poll_oneoff. File descriptors are always considered ready.
+// If none are given, it sleeps until the earliest clock subscription.
+func (wasi *Instance) poll(caller guest, subs []libc.Subscription) ([]libc.Event, *trap) {
+	var events []libc.Event
+	timeouts := make([]time.Duration, len(subs))
+	timeout := time.Duration(-1)
+	for i, sub := range subs {
+		switch sub.Type {
+		case libc.EventtypeFdRead, libc.EventtypeFdWrite:
+			ev := libc.Event{Userdata: sub.Userdata, Type: sub.Type}
+			if _, errno := wasi.get(libc.Int(sub.ID)); errno != libc.ErrnoSuccess {
+				ev.Error = uint16(errno)
+			}
+			events = append(events, ev)
+		case libc.EventtypeClock:
+			d := time.Duration(sub.Timeout)
+			if sub.Flags&libc.SubscriptionClockAbstime != 0 {
+				d = time.Unix(0, int64(sub.Timeout)).Sub(wasi.clock.Now())
+			}
+			if d < 0 {
+				d = 0
+			}
+			timeouts[i] = d
+			if timeout < 0 || d < timeout {
+				timeout = d
+			}
+		default:
+			events = append(events, libc.Event{Userdata: sub.Userdata, Type: sub.Type, Error: uint16(libc.ErrnoInval)})
+		}
+	}
+	if len(events) > 0 || timeout < 0 {
+		return events, nil
+	}
+
+	var done <-chan struct{}
+	if ctx := wasi.callContext(caller); ctx != nil {
+		done = ctx.Done()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+		return nil, wasi.interrupted(caller)
+	}
+	for i, sub := range subs {
+		if sub.Type == libc.EventtypeClock && timeouts[i] <= timeout {
+			events = append(events, libc.Event{Userdata: sub.Userdata, Type: sub.Type})
+		}
+	}
+	return events, nil
+}
@@ -32,5 +32,9 @@ func init() {
 	assert("fdstat", unsafe.Sizeof(Fdstat{}), 24)
 	assert("filestat", unsafe.Sizeof(Filestat{}), 64)
 	assert("dirent", unsafe.Sizeof(Dirent{}), 24)
+	assert("subscription", unsafe.Sizeof(Subscription{}), 48)
+	assert("event", unsafe.Sizeof(Event{}), 32)
+	assert("filestat (snapshot 0)", unsafe.Sizeof(Filestat0{}), 56)
+	assert("subscription (snapshot 0)", unsafe.Sizeof(Subscription0{}), 56)
 	assert("i64", unsafe.Sizeof(int64(0)), 8)
 }
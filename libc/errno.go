@@ -109,6 +109,18 @@ func Error(err error) Errno {
 		return ErrnoNotdir
 	case errors.Is(err, syscall.ENOTEMPTY):
 		return ErrnoNotempty
+	case errors.Is(err, syscall.EROFS):
+		return ErrnoRofs
+	case errors.Is(err, syscall.EIO):
+		return ErrnoIo
+	case errors.Is(err, syscall.EXDEV):
+		return ErrnoXdev
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrnoNospc
+	case errors.Is(err, syscall.EFBIG):
+		return ErrnoFbig
+	case errors.Is(err, syscall.EDQUOT):
+		return ErrnoDquot
 	case errors.Is(err, syscall.ENOSYS):
 		return ErrnoNosys
 	}
@@ -1,9 +1,5 @@
 package libc
 
-import (
-	"syscall"
-)
-
 type Filetype = uint8
 
 const (
@@ -140,58 +136,55 @@ const (
 	RightSockAccept           Rights = (1 << 29)
 )
 
-func OpenFileFlags(df Lookupflag, of Oflag, fd Fdflag, rights Rights) int {
-	// TODO: we probably shouldn't rely on syscall package
-	// might need to implement some of the weirder ones like O_DIRECTORY ourselves
-	// some are defined in fs.FileMode
+// OpenFlags is a portable description of how to open a file, translated from WASI's flags.
+// It doesn't depend on the host's O_* constants, so it means the same thing for every filesystem.
+type OpenFlags struct {
+	Read      bool
+	Write     bool
+	Create    bool
+	Exclusive bool
+	Truncate  bool
+	Append    bool
+	// Directory fails if the file isn't a directory.
+	Directory bool
+	// NoFollow fails if the last path component is a symlink.
+	NoFollow bool
+	Sync     bool
+}
 
-	var gf int
-	if df&LookupflagSymlinkfollow == 0 {
-		gf |= syscall.O_NOFOLLOW
-	}
-	if of&OflagCreat != 0 {
-		gf |= syscall.O_CREAT
-	}
-	if of&OflagDirectory != 0 {
-		gf |= syscall.O_DIRECTORY
-	}
-	if of&OflagExcl != 0 {
-		gf |= syscall.O_EXCL
-	}
-	if of&OflagTrunc != 0 {
-		gf |= syscall.O_TRUNC
-	}
-	if fd&FdflagAppend != 0 {
-		gf |= syscall.O_APPEND
-	}
-	if fd&FdflagDSync != 0 {
-		gf |= syscall.O_DSYNC
-	}
-	if fd&FdflagNonBlock != 0 {
-		gf |= syscall.O_NONBLOCK
-	}
-	// if fd&FdflagRSync != 0 {
-	// 	gf |= syscall.O_RSYNC
-	// }
-	if fd&FdflagSync != 0 {
-		gf |= syscall.O_SYNC
+// OpenFileFlags translates the flags given to path_open.
+func OpenFileFlags(df Lookupflag, of Oflag, fd Fdflag, rights Rights) OpenFlags {
+	flags := OpenFlags{
+		Create:    of&OflagCreat != 0,
+		Exclusive: of&OflagExcl != 0,
+		Truncate:  of&OflagTrunc != 0,
+		Append:    fd&FdflagAppend != 0,
+		Directory: of&OflagDirectory != 0,
+		NoFollow:  df&LookupflagSymlinkfollow == 0,
+		Sync:      fd&(FdflagSync|FdflagDSync|FdflagRSync) != 0,
 	}
 
 	switch {
-	case of&OflagDirectory != 0:
-		gf |= syscall.O_RDONLY
-	case rights&(RightFdRead&RightFdWrite) != 0:
-		gf |= syscall.O_RDWR
+	case flags.Directory:
+		flags.Read = true
+	case rights&RightFdRead != 0 && rights&RightFdWrite != 0:
+		flags.Read = true
+		flags.Write = true
 	case rights&RightFdWrite != 0:
-		gf |= syscall.O_WRONLY
+		flags.Write = true
 	case rights&RightFdRead != 0:
+		flags.Read = true
 		// TODO: is this correct?
-		if of&(OflagCreat|OflagTrunc) != 0 || fd&FdflagAppend != 0 {
-			gf |= syscall.O_RDWR
-		} else {
-			gf |= syscall.O_RDONLY
+		if flags.Create || flags.Truncate || flags.Append {
+			flags.Write = true
 		}
+	default:
+		flags.Read = true
+	}
+	// truncating is always a write, whatever the rights say
+	if flags.Truncate {
+		flags.Write = true
 	}
 
-	return gf
+	return flags
 }
@@ -0,0 +1,50 @@
+package libc
+
+type Eventtype = uint8
+
+const (
+	EventtypeClock   Eventtype = iota // The time value of clock subscription_clock::id has reached timestamp subscription_clock::timeout.
+	EventtypeFdRead                   // File descriptor subscription_fd_readwrite::file_descriptor has data available for reading.
+	EventtypeFdWrite                  // File descriptor subscription_fd_readwrite::file_descriptor has capacity available for writing.
+)
+
+type Subclockflags = uint16
+
+const (
+	SubscriptionClockAbstime Subclockflags = 1 << iota // The timeout is an absolute time, instead of relative to the current time.
+)
+
+type Clockid = uint32
+
+const (
+	ClockRealtime         Clockid = iota // The clock measuring real time.
+	ClockMonotonic                       // The store-wide monotonic clock.
+	ClockProcessCputimeID                // The CPU-time clock associated with the current process.
+	ClockThreadCputimeID                 // The CPU-time clock associated with the current thread.
+)
+
+// Subscription is a subscription_t, used by poll_oneoff.
+// For clock subscriptions, all fields are used.
+// For fd_read and fd_write subscriptions, ID is the file descriptor and the rest are ignored.
+type Subscription struct {
+	Userdata  uint64
+	Type      Eventtype
+	_         [7]byte
+	ID        uint32 // clock ID or file descriptor
+	_         uint32
+	Timeout   uint64
+	Precision uint64
+	Flags     Subclockflags
+	_         [6]byte
+}
+
+// Event is an event_t, the result of a Subscription.
+type Event struct {
+	Userdata uint64
+	Error    uint16
+	Type     Eventtype
+	_        [5]byte
+	Nbytes   uint64 // for fd_read and fd_write
+	Flags    uint16 // for fd_read and fd_write
+	_        [6]byte
+}
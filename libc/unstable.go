@@ -0,0 +1,77 @@
+package libc
+
+import "math"
+
+// The wasi_unstable (snapshot 0) types that differ from wasi_snapshot_preview1.
+
+// Filestat0 is snapshot 0's filestat_t, which has a 32-bit link count.
+type Filestat0 struct {
+	Dev      uint64
+	Ino      uint64
+	Filetype Filetype
+	Nlink    uint32
+	Size     uint64
+	Atim     uint64
+	Mtim     uint64
+	Ctim     uint64
+}
+
+// Snapshot0 converts the filestat to its snapshot 0 layout.
+func (st Filestat) Snapshot0() Filestat0 {
+	nlink := st.Nlink
+	if nlink > math.MaxUint32 {
+		nlink = math.MaxUint32
+	}
+	return Filestat0{
+		Dev:      st.Dev,
+		Ino:      st.Ino,
+		Filetype: st.Filetype,
+		Nlink:    uint32(nlink),
+		Size:     st.Size,
+		Atim:     st.Atim,
+		Mtim:     st.Mtim,
+		Ctim:     st.Ctim,
+	}
+}
+
+type Whence0 = uint8
+
+// Snapshot 0 whence values, in a different order from io.SeekStart and friends.
+const (
+	Whence0Cur Whence0 = iota // Seek relative to current position.
+	Whence0End                // Seek relative to end-of-file.
+	Whence0Set                // Seek relative to start-of-file.
+)
+
+// Subscription0 is snapshot 0's subscription_t.
+// Clock subscriptions have an extra identifier field, moving the rest down.
+// For fd_read and fd_write subscriptions, the low 32 bits of Identifier are the file descriptor.
+type Subscription0 struct {
+	Userdata   uint64
+	Type       Eventtype
+	_          [7]byte
+	Identifier uint64 // user-defined for clocks, or file descriptor
+	ID         Clockid
+	_          uint32
+	Timeout    uint64
+	Precision  uint64
+	Flags      Subclockflags
+	_          [6]byte
+}
+
+// Preview1 converts the subscription to its preview1 layout.
+func (sub Subscription0) Preview1() Subscription {
+	s := Subscription{
+		Userdata: sub.Userdata,
+		Type:     sub.Type,
+	}
+	if sub.Type == EventtypeClock {
+		s.ID = sub.ID
+		s.Timeout = sub.Timeout
+		s.Precision = sub.Precision
+		s.Flags = sub.Flags
+	} else {
+		s.ID = uint32(sub.Identifier)
+	}
+	return s
+}
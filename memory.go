@@ -1,15 +1,42 @@
 package hammertime
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"unsafe"
 
-	"github.com/bytecodealliance/wasmtime-go/v11"
 	"github.com/guregu/hammertime/libc"
 	"golang.org/x/exp/slices"
 )
 
+// guest is the calling guest, as seen by host functions.
+// Each runtime adapter (wasmtime, wazero) provides its own.
+type guest interface {
+	// memory returns the guest's exported linear memory, or nil if there isn't any.
+	// It's only valid until the guest runs again, as memory can grow.
+	memory() []byte
+	// context returns the context of the call into the guest, for runtimes that pass one to host functions.
+	// Otherwise it's nil, and the instance's context (set by Instance.Call) applies.
+	context() context.Context
+}
+
+// trap stops the guest. Runtime adapters turn it into their own kind of trap.
+type trap struct {
+	msg string
+}
+
+func newTrap(msg string) *trap {
+	return &trap{msg: msg}
+}
+
+func (t *trap) Error() string {
+	return t.msg
+}
+
+var errNoMemory = errors.New("hammertime: guest doesn't export memory")
+
 type segfault struct {
 	addr libc.Ptr
 	max  libc.Ptr
@@ -21,16 +48,18 @@ func (sf segfault) Error() string {
 
 // ensure performs bounds checking on the addresses given to it,
 // then calls a function that can access raw memory.
-func ensure(caller *wasmtime.Caller, fn func(base unsafe.Pointer, data []byte), addrs ...libc.Ptr) error {
+func ensure(caller guest, fn func(base unsafe.Pointer, data []byte), addrs ...libc.Ptr) error {
 	// const max32 = 1 << 32
 
-	mem := caller.GetExport("memory").Memory()
-	defer runtime.KeepAlive(mem)
+	data := caller.memory()
+	if data == nil {
+		return errNoMemory
+	}
+	defer runtime.KeepAlive(caller)
 
-	base := mem.Data(caller)
-	datasize := mem.DataSize(caller)
+	base := unsafe.Pointer(unsafe.SliceData(data))
+	datasize := len(data)
 	maxphysaddr := libc.Size(datasize)
-	data := unsafe.Slice((*byte)(base), datasize)
 
 	// if datasize >= max32 {
 	// 	return fmt.Errorf("memory is too big for wasm32: %d", datasize)
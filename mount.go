@@ -0,0 +1,220 @@
+package hammertime
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// mountfs overlays other filesystems on top of a root filesystem.
+// Mount points don't need to exist in the root; missing parent directories are synthesized.
+// It implements hackpadfs.MountFS, so the hackpadfs helpers (OpenFile, Mkdir, etc.) dispatch to the right mount.
+type mountfs struct {
+	root   hackpadfs.FS
+	mounts map[string]hackpadfs.FS // path (without leading slash) → fs
+}
+
+type mountpoint struct {
+	path string
+	fs   hackpadfs.FS
+}
+
+func newMountFS(root hackpadfs.FS) *mountfs {
+	if root == nil {
+		root = emptyFS{}
+	}
+	return &mountfs{
+		root:   root,
+		mounts: make(map[string]hackpadfs.FS),
+	}
+}
+
+func (m *mountfs) add(name string, fsys hackpadfs.FS) {
+	m.mounts[cleanPath(name)] = fsys
+}
+
+// Mount implements hackpadfs.MountFS.
+func (m *mountfs) Mount(name string) (hackpadfs.FS, string) {
+	fsys, _, sub := m.mountPoint(name)
+	return fsys, sub
+}
+
+func (m *mountfs) mountPoint(name string) (fsys hackpadfs.FS, point, sub string) {
+	fsys, point, sub = m.root, ".", name
+	for mp, mfs := range m.mounts {
+		switch {
+		case name == mp:
+			return mfs, mp, "."
+		case strings.HasPrefix(name, mp+"/") && (point == "." || len(mp) > len(point)):
+			fsys, point, sub = mfs, mp, name[len(mp)+1:]
+		}
+	}
+	return
+}
+
+// children returns the names of mount points directly inside of dir,
+// and whether dir contains any mount points at all.
+func (m *mountfs) children(dir string) (names []string, ancestor bool) {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	for mp := range m.mounts {
+		if !strings.HasPrefix(mp, prefix) || mp == dir {
+			continue
+		}
+		ancestor = true
+		rest := mp[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			rest = rest[:i]
+		}
+		if !slices.Contains(names, rest) {
+			names = append(names, rest)
+		}
+	}
+	slices.Sort(names)
+	return
+}
+
+// Open implements fs.FS.
+func (m *mountfs) Open(name string) (fs.File, error) {
+	fsys, sub := m.Mount(name)
+	f, err := fsys.Open(sub)
+	if err != nil {
+		if _, ancestor := m.children(name); ancestor {
+			return m.syntheticDir(name)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat implements hackpadfs.StatFS.
+func (m *mountfs) Stat(name string) (fs.FileInfo, error) {
+	fsys, sub := m.Mount(name)
+	info, err := hackpadfs.Stat(fsys, sub)
+	if err != nil {
+		if _, ancestor := m.children(name); ancestor {
+			return dirinfo(name), nil
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// Lstat implements ReadLinkFS.
+func (m *mountfs) Lstat(name string) (fs.FileInfo, error) {
+	fsys, sub := m.Mount(name)
+	info, err := lstatFS(fsys, sub)
+	if err != nil {
+		if _, ancestor := m.children(name); ancestor {
+			return dirinfo(name), nil
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadLink implements ReadLinkFS.
+func (m *mountfs) ReadLink(name string) (string, error) {
+	fsys, sub := m.Mount(name)
+	if lfs, ok := fsys.(ReadLinkFS); ok {
+		return lfs.ReadLink(sub)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: hackpadfs.ErrNotImplemented}
+}
+
+// ReadDir implements hackpadfs.ReadDirFS.
+// Mount points are merged into their parent directory's entries.
+func (m *mountfs) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys, sub := m.Mount(name)
+	ents, err := hackpadfs.ReadDir(fsys, sub)
+	mounted, ancestor := m.children(name)
+	if err != nil && !ancestor {
+		return nil, err
+	}
+	byName := make(map[string]fs.DirEntry, len(ents)+len(mounted))
+	for _, ent := range ents {
+		byName[ent.Name()] = ent
+	}
+	for _, child := range mounted {
+		byName[child] = fs.FileInfoToDirEntry(dirinfo(child))
+	}
+	names := maps.Keys(byName)
+	slices.Sort(names)
+	ents = ents[:0]
+	for _, name := range names {
+		ents = append(ents, byName[name])
+	}
+	return ents, nil
+}
+
+// Rename implements hackpadfs.RenameFS.
+func (m *mountfs) Rename(oldname, newname string) error {
+	oldfs, oldpoint, oldsub := m.mountPoint(oldname)
+	_, newpoint, newsub := m.mountPoint(newname)
+	if oldpoint != newpoint {
+		return &hackpadfs.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	return hackpadfs.Rename(oldfs, oldsub, newsub)
+}
+
+func (m *mountfs) syntheticDir(name string) (fs.File, error) {
+	children, _ := m.children(name)
+	ents := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		ents = append(ents, fs.FileInfoToDirEntry(dirinfo(child)))
+	}
+	return &vdir{info: dirinfo(name), entries: ents}, nil
+}
+
+// emptyFS is used as the root of a mountfs when no user filesystem is given.
+type emptyFS struct{}
+
+func (emptyFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// vdir is an in-memory, read-only directory.
+type vdir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *vdir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *vdir) Close() error               { return nil }
+
+func (d *vdir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: syscall.EISDIR}
+}
+
+func (d *vdir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.pos += n
+	return rest[:n], nil
+}
+
+func dirinfo(name string) fileinfo {
+	return fileinfo{
+		name:  path.Base(name),
+		mode:  fs.ModeDir | 0555,
+		isDir: true,
+	}
+}
@@ -0,0 +1,125 @@
+package hammertime
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// Op is a filesystem operation checked by a Policy.
+type Op int
+
+const (
+	// OpRead is opening a file or directory for reading.
+	OpRead Op = iota
+	// OpWrite is opening an existing file for writing.
+	OpWrite
+	// OpCreate is creating a new file.
+	OpCreate
+	// OpMkdir is creating a directory.
+	OpMkdir
+	// OpRemove is removing a file or directory.
+	OpRemove
+	// OpRename is renaming a file or directory. It is checked for both the old and new paths.
+	OpRename
+	// OpReadlink is reading a symbolic link.
+	OpReadlink
+	// OpStat is getting a file's metadata by path. Directory listings leave out entries it denies.
+	OpStat
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpCreate:
+		return "create"
+	case OpMkdir:
+		return "mkdir"
+	case OpRemove:
+		return "remove"
+	case OpRename:
+		return "rename"
+	case OpReadlink:
+		return "readlink"
+	case OpStat:
+		return "stat"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Policy decides whether the guest may perform op on the file at path.
+// path is absolute and canonical (symlinks are already resolved), such as "/config/app.yaml".
+// It is consulted when a path is opened, created, removed, renamed, read as a link, or stat'd,
+// and for each entry of a directory listing.
+// Operations on file descriptors that are already open (reads, writes, fd_filestat_get, and so on) aren't checked again,
+// and neither are preopened directories themselves.
+// Returning a non-nil error denies access, failing with EACCES,
+// or ENOTCAPABLE if the error wraps ErrNotCapable.
+type Policy func(op Op, path string) error
+
+// ErrNotCapable can be returned by a Policy to fail with ENOTCAPABLE instead of EACCES.
+var ErrNotCapable = errors.New("not capable")
+
+// WithPolicy restricts filesystem access with the given policy,
+// which is consulted before opening, creating, removing, renaming, stat'ing, listing, or reading links. See Policy.
+func WithPolicy(policy Policy) Option {
+	return func(wasi *WASI) {
+		wasi.policy = policy
+	}
+}
+
+// GlobPolicy returns a Policy that allows paths matching any of the allow patterns,
+// unless they match any of the deny patterns. If allow is empty, everything not denied is allowed.
+// Patterns use path.Match syntax against absolute paths, and a pattern also matches everything inside
+// of the directories it matches. For example, "/config/secrets" denies "/config/secrets/key.pem".
+// Invalid patterns never match.
+func GlobPolicy(allow, deny []string) Policy {
+	return func(op Op, name string) error {
+		if globMatch(deny, name) {
+			return fs.ErrPermission
+		}
+		if len(allow) > 0 && !globMatch(allow, name) {
+			return fs.ErrPermission
+		}
+		return nil
+	}
+}
+
+// globMatch reports whether name or any of its parent directories match any of patterns.
+func globMatch(patterns []string, name string) bool {
+	for dir := name; ; dir = path.Dir(dir) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, dir); ok {
+				return true
+			}
+		}
+		if dir == "/" || dir == "." {
+			return false
+		}
+	}
+}
+
+// allow checks the policy for op on name (relative to the root).
+func (fsys *filesystem) allow(op Op, name string) libc.Errno {
+	if fsys.policy == nil {
+		return libc.ErrnoSuccess
+	}
+	guest := "/" + name
+	if name == "." {
+		guest = "/"
+	}
+	err := fsys.policy(op, guest)
+	switch {
+	case err == nil:
+		return libc.ErrnoSuccess
+	case errors.Is(err, ErrNotCapable):
+		return libc.ErrnoNotcapable
+	}
+	return libc.ErrnoAcces
+}
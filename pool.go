@@ -0,0 +1,126 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+// Pool runs a command module many times, such as once per request in a server.
+// The module is compiled and the WASI functions are defined once, up front;
+// each run gets a fresh store and instance, with its own WASI state.
+// Stores are never reused, so nothing in the guest's memory leaks from one run to the next.
+//
+// Each slot has its own engine with epoch interruption enabled,
+// so cancelling one run never interrupts the others.
+type Pool struct {
+	compiled []byte
+	wasi     *WASI
+	slots    chan *slot
+}
+
+// slot is an engine that runs one guest at a time, along with the module compiled for it.
+type slot struct {
+	engine *wasmtime.Engine
+	module *wasmtime.Module
+	linker *wasmtime.Linker
+}
+
+// NewPool creates a pool running the given WebAssembly binary module, with at most max runs at once.
+// If max is 0 or less, runtime.GOMAXPROCS(0) is used.
+// The given options apply to every run, and can be added to or overridden for each run. See WASI.NewInstance.
+// It returns ErrComponent for preview2 components.
+func NewPool(wasm []byte, max int, opts ...Option) (*Pool, error) {
+	if isComponent(wasm) {
+		return nil, ErrComponent
+	}
+	if max <= 0 {
+		max = runtime.GOMAXPROCS(0)
+	}
+	engine := newEpochEngine()
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := module.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	p := &Pool{
+		compiled: compiled,
+		wasi:     NewWASI(opts...),
+		slots:    make(chan *slot, max),
+	}
+	if err := p.wasi.err; err != nil {
+		return nil, err
+	}
+	first, err := p.link(engine, module)
+	if err != nil {
+		return nil, err
+	}
+	p.slots <- first
+	// the rest are made when first needed
+	for i := 1; i < max; i++ {
+		p.slots <- nil
+	}
+	return p, nil
+}
+
+// Run runs the module's _start function in a fresh instance, with opts applied on top of the pool's options.
+// It waits for a free slot first, returning ctx.Err() if the context is done before one is available.
+// The returned error is as described for Cmd.Run.
+func (p *Pool) Run(ctx context.Context, opts ...Option) error {
+	var s *slot
+	select {
+	case s = <-p.slots:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { p.slots <- s }()
+	if s == nil {
+		var err error
+		if s, err = p.newSlot(); err != nil {
+			return err
+		}
+	}
+
+	store := wasmtime.NewStore(s.engine)
+	wasi, err := p.wasi.NewInstance(store, opts...)
+	if err != nil {
+		return err
+	}
+	defer wasi.Close()
+	instance, err := s.linker.Instantiate(store, s.module)
+	if err != nil {
+		return err
+	}
+	_, err = wasi.exitStatus(wasi.Run(ctx, store, instance))
+	return err
+}
+
+func (p *Pool) newSlot() (*slot, error) {
+	engine := newEpochEngine()
+	module, err := wasmtime.NewModuleDeserialize(engine, p.compiled)
+	if err != nil {
+		return nil, err
+	}
+	return p.link(engine, module)
+}
+
+func (p *Pool) link(engine *wasmtime.Engine, module *wasmtime.Module) (*slot, error) {
+	linker := wasmtime.NewLinker(engine)
+	if err := p.wasi.Define(linker); err != nil {
+		return nil, err
+	}
+	return &slot{engine: engine, module: module, linker: linker}, nil
+}
+
+// newEpochEngine returns an engine with epoch interruption enabled, so guests can be cancelled.
+func newEpochEngine() *wasmtime.Engine {
+	cfg := wasmtime.NewConfig()
+	cfg.SetEpochInterruption(true)
+	return wasmtime.NewEngineWithConfig(cfg)
+}
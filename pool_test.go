@@ -0,0 +1,156 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+func TestPool(t *testing.T) {
+	// echoes up to 64 bytes of stdin to stdout
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_read" (func $read (param i32 i32 i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+		(memory (export "memory") 1)
+		(func (export "_start")
+			(i32.store (i32.const 0) (i32.const 64))
+			(i32.store (i32.const 4) (i32.const 64))
+			(drop (call $read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+			(i32.store (i32.const 4) (i32.load (i32.const 8)))
+			(drop (call $write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const max = 2
+	pool, err := NewPool(wasm, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := fmt.Sprintf("request %d", i)
+			stdin := &slowReader{Reader: strings.NewReader(input), running: &running, peak: &peak}
+			stdout := new(bytes.Buffer)
+			if err := pool.Run(context.Background(), WithStdin(stdin), WithStdout(stdout)); err != nil {
+				t.Error(i, err)
+			}
+			if got := stdout.String(); got != input {
+				t.Error("bad stdout. want:", input, "got:", got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := peak.Load(); got > max {
+		t.Error("too many concurrent runs. max:", max, "got:", got)
+	}
+	leaked := 0
+	pool.wasi.instances.Range(func(_, _ any) bool {
+		leaked++
+		return true
+	})
+	if leaked != 0 {
+		t.Error("instances leaked:", leaked)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	// reads a byte from stdin: loops forever on "x", otherwise spins a while and echoes it
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_read" (func $read (param i32 i32 i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+		(memory (export "memory") 1)
+		(func (export "_start") (local $i i32)
+			(i32.store (i32.const 0) (i32.const 64))
+			(i32.store (i32.const 4) (i32.const 1))
+			(drop (call $read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+			(if (i32.eq (i32.load8_u (i32.const 64)) (i32.const 120))
+				(then (loop $forever (br $forever))))
+			(loop $spin
+				(local.set $i (i32.add (local.get $i) (i32.const 1)))
+				(br_if $spin (i32.lt_u (local.get $i) (i32.const 100000))))
+			(drop (call $write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(wasm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start a run that spins until cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	looping := make(chan struct{})
+	cancelled := make(chan error)
+	go func() {
+		cancelled <- pool.Run(ctx, WithStdin(&signalReader{Reader: strings.NewReader("x"), signal: looping}))
+	}()
+
+	// start another run, held in fd_read until the first is cancelled
+	stdin, release := io.Pipe()
+	stdout := new(bytes.Buffer)
+	finished := make(chan error)
+	go func() {
+		finished <- pool.Run(context.Background(), WithStdin(stdin), WithStdout(stdout))
+	}()
+
+	<-looping
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Error("cancelled run: want context.Canceled, got:", err)
+	}
+	if _, err := release.Write([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-finished; err != nil {
+		t.Error("other run was interrupted:", err)
+	}
+	if got := stdout.String(); got != "y" {
+		t.Error("bad stdout. want: y got:", got)
+	}
+}
+
+// signalReader closes signal on its first read.
+type signalReader struct {
+	*strings.Reader
+	signal chan struct{}
+	once   sync.Once
+}
+
+func (r *signalReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.signal) })
+	return r.Reader.Read(p)
+}
+
+type slowReader struct {
+	*strings.Reader
+	running, peak *atomic.Int32
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	n := r.running.Add(1)
+	defer r.running.Add(-1)
+	for {
+		peak := r.peak.Load()
+		if n <= peak || r.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,125 @@
+package hammertime
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+
+	"github.com/hack-pad/hackpadfs"
+)
+
+// Limits restricts how much the guest may write to its filesystem.
+// Zero values mean unlimited.
+//
+// Limits apply to each instance separately: every instance of a WASI
+// (from NewInstance, NewContext, or a Pool run) starts with its own, empty Usage,
+// even if it shares a filesystem with the others.
+type Limits struct {
+	// MaxBytes is the total number of bytes the guest may write to files.
+	// Writes past this fail with ENOSPC.
+	MaxBytes int64
+	// MaxFileSize is the largest size a file may be written to.
+	// Writes past this fail with EFBIG.
+	MaxFileSize int64
+	// MaxFiles is the number of files and directories the guest may create.
+	// Creating more fails with EDQUOT.
+	MaxFiles int
+}
+
+// Usage is how much of its Limits the guest has used so far.
+type Usage struct {
+	// BytesWritten is the total number of bytes written to files (not including stdout or stderr).
+	BytesWritten int64
+	// FilesCreated is the number of files and directories created.
+	FilesCreated int
+}
+
+// WithLimits restricts filesystem usage. See Limits.
+func WithLimits(limits Limits) Option {
+	return func(wasi *WASI) {
+		wasi.limits = limits
+	}
+}
+
+// Usage returns the instance's filesystem usage so far.
+// It can be called after the guest exits.
+func (wasi *Instance) Usage() Usage {
+	wasi.quota.mu.Lock()
+	defer wasi.quota.mu.Unlock()
+	return wasi.quota.Usage
+}
+
+type quota struct {
+	Limits
+	Usage
+	mu sync.Mutex // guards Usage
+}
+
+// create reserves room for a new file.
+// If creating it fails, call release.
+func (q *quota) create() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.MaxFiles > 0 && q.FilesCreated >= q.MaxFiles {
+		return syscall.EDQUOT
+	}
+	q.FilesCreated++
+	return nil
+}
+
+func (q *quota) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.FilesCreated--
+}
+
+// write writes as much of p to f as the limits allow.
+// Like a full disk, short writes are allowed, and it is only an error if nothing can be written.
+func (q *quota) write(f hackpadfs.File, w io.Writer, p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, err := q.allow(f, p)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(p)
+	q.BytesWritten += int64(n)
+	return n, err
+}
+
+// allow returns the part of p that may be written to f. q.mu must be held.
+func (q *quota) allow(f hackpadfs.File, p []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return p, nil
+	}
+	if q.MaxFileSize > 0 {
+		off, err := hackpadfs.SeekFile(f, 0, io.SeekCurrent)
+		if errors.Is(err, hackpadfs.ErrNotImplemented) {
+			// no way to tell: assume the end, where sequential writes go
+			var info fs.FileInfo
+			if info, err = f.Stat(); err == nil {
+				off = info.Size()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if max := q.MaxFileSize - off; int64(len(p)) > max {
+			if max <= 0 {
+				return nil, syscall.EFBIG
+			}
+			p = p[:max]
+		}
+	}
+	if q.MaxBytes > 0 {
+		if max := q.MaxBytes - q.BytesWritten; int64(len(p)) > max {
+			if max <= 0 {
+				return nil, syscall.ENOSPC
+			}
+			p = p[:max]
+		}
+	}
+	return p, nil
+}
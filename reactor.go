@@ -0,0 +1,107 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+// Initialize calls the reactor module's _initialize function, if it exports one.
+// It only calls it the first time, so it's safe to call again for the same instance.
+func (wasi *Instance) Initialize(ctx context.Context, store *wasmtime.Store, instance *wasmtime.Instance) error {
+	if wasi.initialized {
+		return nil
+	}
+	wasi.initialized = true
+	init := instance.GetFunc(store, "_initialize")
+	if init == nil {
+		return nil
+	}
+	_, err := wasi.Call(ctx, store, init)
+	return err
+}
+
+// Reactor is an instantiated reactor module: instead of running main once,
+// it exports functions that can be called many times, sharing the same WASI state (open files, etc.).
+// Calls are serialized, so a Reactor is safe to use from multiple goroutines.
+type Reactor struct {
+	wasi     *Instance
+	store    *wasmtime.Store
+	instance *wasmtime.Instance
+	mu       sync.Mutex
+}
+
+// NewReactor instantiates module in a new store with the given WASI options, then calls its _initialize function.
+// The engine should have epoch interruption enabled for calls to be cancellable. See Instance.Call.
+func NewReactor(ctx context.Context, engine *wasmtime.Engine, module *wasmtime.Module, opts ...Option) (*Reactor, error) {
+	store := wasmtime.NewStore(engine)
+	linker := wasmtime.NewLinker(engine)
+	wasi := NewWASI(opts...)
+	if err := wasi.Link(store, linker); err != nil {
+		wasi.Close()
+		return nil, err
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		wasi.Close()
+		return nil, err
+	}
+	r := &Reactor{
+		wasi:     wasi.Instance,
+		store:    store,
+		instance: instance,
+	}
+	if err := r.wasi.Initialize(ctx, store, instance); err != nil {
+		r.wasi.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Call calls the exported function with the given name and returns its result.
+// See Instance.Call for how ctx is handled.
+// If the guest has exited, it returns *ExitError without calling anything.
+func (r *Reactor) Call(ctx context.Context, name string, args ...any) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if code, exited := r.wasi.ExitCode(); exited {
+		return nil, &ExitError{Code: code}
+	}
+	fn := r.instance.GetFunc(r.store, name)
+	if fn == nil {
+		return nil, fmt.Errorf("hammertime: no exported function %q", name)
+	}
+	return r.wasi.Call(ctx, r.store, fn, args...)
+}
+
+// Instance returns the reactor's WASI state.
+func (r *Reactor) Instance() *Instance {
+	return r.wasi
+}
+
+// Close releases the reactor's WASI resources.
+func (r *Reactor) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wasi.Close()
+}
+
+// Call calls the reactor's exported function with the given name, returning its result as T.
+// Results map to Go types as with wasmtime.Func.Call: int32, int64, float32, float64, and so on.
+// Functions without results return the zero value of T.
+func Call[T any](ctx context.Context, r *Reactor, name string, args ...any) (T, error) {
+	var zero T
+	result, err := r.Call(ctx, name, args...)
+	if err != nil || result == nil {
+		return zero, err
+	}
+	v, ok := result.(T)
+	if !ok {
+		return zero, fmt.Errorf("hammertime: %s returned %T, not %T", name, result, zero)
+	}
+	return v, nil
+}
@@ -0,0 +1,74 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+func TestReactor(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+		(memory (export "memory") 1)
+		(global $n (mut i32) (i32.const 0))
+		(data (i32.const 64) "hi\n")
+		(func (export "_initialize") (global.set $n (i32.const 40)))
+		(func (export "add") (param i32) (result i32)
+			(global.set $n (i32.add (global.get $n) (local.get 0)))
+			(global.get $n))
+		(func (export "hello")
+			(i32.store (i32.const 0) (i32.const 64))
+			(i32.store (i32.const 4) (i32.const 3))
+			(drop (call $write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8))))
+		(func (export "exit") (call $exit (i32.const 1))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := wasmtime.NewEngine()
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	stdout := new(bytes.Buffer)
+	r, err := NewReactor(ctx, engine, module, WithStdout(stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, want := range []int32{41, 42} {
+		got, err := Call[int32](ctx, r, "add", int32(1))
+		if err != nil || got != want {
+			t.Error("add: want:", want, "got:", got, err)
+		}
+	}
+	if _, err := Call[int64](ctx, r, "add", int32(1)); err == nil {
+		t.Error("expected error for wrong result type")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Call[any](ctx, r, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := stdout.String(); got != "hi\nhi\n" {
+		t.Error("bad stdout:", got)
+	}
+	if _, err := r.Call(ctx, "missing"); err == nil {
+		t.Error("expected error for missing export")
+	}
+
+	if _, err := r.Call(ctx, "exit"); err == nil {
+		t.Error("expected exit trap")
+	}
+	var ee *ExitError
+	if _, err := r.Call(ctx, "add", int32(1)); !errors.As(err, &ee) || ee.Code != 1 {
+		t.Error("want exit status 1, got:", err)
+	}
+}
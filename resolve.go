@@ -0,0 +1,212 @@
+package hammertime
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/hack-pad/hackpadfs"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+const (
+	// maxSymlinks is the maximum number of symlinks followed while resolving a path, same as Linux.
+	maxSymlinks = 40
+	// maxPathLen is the maximum length of a path given by the guest (PATH_MAX).
+	maxPathLen = 4096
+	// maxNameLen is the maximum length of a single path component (NAME_MAX).
+	maxNameLen = 255
+)
+
+// ReadLinkFS is a filesystem that supports symbolic links.
+// It mirrors fs.ReadLinkFS from newer versions of Go, so os.DirFS satisfies it there.
+//
+// Symlinks are resolved by hammertime itself, so filesystems that contain symlinks
+// but don't implement this interface will refuse to follow them (with ENOTCAPABLE).
+// Filesystems without any Lstat method have their symlinks found through directory listings,
+// which is slower but keeps filesystems like os.DirFS from following them out of the root.
+type ReadLinkFS interface {
+	fs.FS
+	// ReadLink returns the destination of the named symbolic link.
+	ReadLink(name string) (string, error)
+	// Lstat returns info about the named file without following symlinks.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// resolve turns a guest path into a canonical path relative to the root of fsys.fs,
+// starting from dir (which must already be canonical).
+// It walks the path one component at a time, following symlinks along the way,
+// and never returns a path outside of the root.
+// If follow is false, a symlink in the last component is not followed.
+func (fsys *filesystem) resolve(dir, name string, follow bool) (string, libc.Errno) {
+	if len(name) > maxPathLen {
+		return "", libc.ErrnoNametoolong
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", libc.ErrnoInval
+	}
+
+	var stack []string
+	if dir != "." && dir != "" {
+		stack = strings.Split(dir, "/")
+	}
+	rest := strings.Split(name, "/")
+	if strings.HasPrefix(name, "/") {
+		stack = stack[:0]
+	}
+
+	links := 0
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) == 0 {
+				// trying to escape the root
+				return "", libc.ErrnoNotcapable
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if len(elem) > maxNameLen {
+			return "", libc.ErrnoNametoolong
+		}
+
+		stack = append(stack, elem)
+		last := !hasMore(rest)
+		if last && !follow {
+			break
+		}
+
+		cur := strings.Join(stack, "/")
+		info, err := fsys.lstat(cur)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if last {
+				// might be about to be created
+				continue
+			}
+			return "", libc.ErrnoNoent
+		case err != nil:
+			return "", libc.Error(err)
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			if !last && !info.IsDir() {
+				return "", libc.ErrnoNotdir
+			}
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", libc.ErrnoLoop
+		}
+		target, errno := fsys.readlinkRaw(cur)
+		if errno != libc.ErrnoSuccess {
+			return "", errno
+		}
+		stack = stack[:len(stack)-1]
+		if strings.HasPrefix(target, "/") {
+			// absolute symlinks are relative to the root, never the host
+			stack = stack[:0]
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	if len(stack) == 0 {
+		return ".", libc.ErrnoSuccess
+	}
+	return strings.Join(stack, "/"), libc.ErrnoSuccess
+}
+
+// resolveAllowed is resolve for an operation subject to the policy.
+// op is checked on the path as written before anything is looked up, so a denied path
+// can't be probed through the errors from resolving it, then again on the resolved path,
+// which symlinks may have taken elsewhere.
+func (fsys *filesystem) resolveAllowed(op Op, dir, name string, follow bool) (string, libc.Errno) {
+	written := name
+	if !strings.HasPrefix(name, "/") {
+		written = path.Join("/", dir, name)
+	}
+	written = strings.TrimPrefix(path.Clean(written), "/")
+	if written == "" {
+		written = "."
+	}
+	if errno := fsys.allow(op, written); errno != libc.ErrnoSuccess {
+		return "", errno
+	}
+	resolved, errno := fsys.resolve(dir, name, follow)
+	if errno != libc.ErrnoSuccess {
+		return "", errno
+	}
+	if errno := fsys.allow(op, resolved); errno != libc.ErrnoSuccess {
+		return "", errno
+	}
+	return resolved, libc.ErrnoSuccess
+}
+
+func hasMore(rest []string) bool {
+	for _, elem := range rest {
+		if elem != "" && elem != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// lstat stats a file without following symlinks.
+func (fsys *filesystem) lstat(name string) (fs.FileInfo, error) {
+	return lstatFS(fsys.fs, name)
+}
+
+// lstatFS stats a file in fsys without following symlinks.
+// If fsys can't Lstat, its Stat might follow a symlink (on the host, out of the root),
+// so the parent directory's listing is checked for a symlink first.
+func lstatFS(fsys fs.FS, name string) (fs.FileInfo, error) {
+	switch lfs := fsys.(type) {
+	case ReadLinkFS:
+		return lfs.Lstat(name)
+	case hackpadfs.LstatFS:
+		return lfs.Lstat(name)
+	}
+	if name != "." {
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir == "" {
+			dir = "."
+		}
+		if entries, err := fs.ReadDir(fsys, dir); err == nil {
+			for _, entry := range entries {
+				if entry.Name() == base && entry.Type()&fs.ModeSymlink != 0 {
+					return entry.Info()
+				}
+			}
+		}
+	}
+	return fs.Stat(fsys, name)
+}
+
+// readlinkRaw reads a symlink's target without resolving its path.
+func (fsys *filesystem) readlinkRaw(name string) (string, libc.Errno) {
+	lfs, ok := fsys.fs.(ReadLinkFS)
+	if !ok {
+		// the underlying filesystem would follow it for us, possibly out of the sandbox
+		return "", libc.ErrnoNotcapable
+	}
+	target, err := lfs.ReadLink(name)
+	if errors.Is(err, hackpadfs.ErrNotImplemented) {
+		return "", libc.ErrnoNotcapable
+	}
+	if err != nil {
+		return "", libc.Error(err)
+	}
+	if len(target) > maxPathLen {
+		return "", libc.ErrnoNametoolong
+	}
+	return target, libc.ErrnoSuccess
+}
@@ -0,0 +1,129 @@
+package hammertime
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// linkFS adds fake symlinks to an in-memory filesystem.
+type linkFS struct {
+	*mem.FS
+	links map[string]string
+}
+
+func (lfs linkFS) ReadLink(name string) (string, error) {
+	target, ok := lfs.links[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return target, nil
+}
+
+func (lfs linkFS) Lstat(name string) (fs.FileInfo, error) {
+	if _, ok := lfs.links[name]; ok {
+		return fileinfo{name: name, mode: fs.ModeSymlink | 0777}, nil
+	}
+	return lfs.FS.Stat(name)
+}
+
+func TestResolve(t *testing.T) {
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memfs.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := memfs.Mkdir("etc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "file.txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs := linkFS{FS: memfs, links: map[string]string{
+		"a/abs":  "/etc",
+		"a/rel":  "b",
+		"a/up":   "../../..",
+		"loop1":  "loop2",
+		"loop2":  "loop1",
+		"a/b/ln": "../../file.txt",
+	}}
+	wasi := NewWASI(WithFS(lfs))
+
+	cases := []struct {
+		dir    string
+		name   string
+		follow bool
+		want   string
+		errno  libc.Errno
+	}{
+		{".", "a/b/../b", true, "a/b", 0},
+		{".", "/a/b", true, "a/b", 0},
+		{"a/b", "../../etc", true, "etc", 0},
+		{"a", "new.txt", true, "a/new.txt", 0},
+		{".", "..", true, "", libc.ErrnoNotcapable},
+		{"a", "b/../../../x", true, "", libc.ErrnoNotcapable},
+		{".", "a/abs", true, "etc", 0},
+		{".", "a/abs", false, "a/abs", 0},
+		{".", "a/abs/x", false, "etc/x", 0},
+		{".", "a/rel/ln", true, "file.txt", 0},
+		{".", "a/up/x", true, "", libc.ErrnoNotcapable},
+		{".", "loop1", true, "", libc.ErrnoLoop},
+		{".", "file.txt/x", true, "", libc.ErrnoNotdir},
+		{".", "nope/x", true, "", libc.ErrnoNoent},
+		{".", strings.Repeat("x", maxNameLen+1), true, "", libc.ErrnoNametoolong},
+		{".", strings.Repeat("x/", maxPathLen), true, "", libc.ErrnoNametoolong},
+	}
+	for _, tc := range cases {
+		got, errno := wasi.resolve(tc.dir, tc.name, tc.follow)
+		if got != tc.want || errno != tc.errno {
+			t.Errorf("resolve(%q, %.20q, %v): want: %q %d got: %q %d", tc.dir, tc.name, tc.follow, tc.want, tc.errno, got, errno)
+		}
+	}
+}
+
+// noLstatFS hides everything but Open, like a custom fs.FS reading from the host.
+type noLstatFS struct {
+	fs.FS
+}
+
+func TestResolveNoLstat(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ok.txt"), []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink(dir, filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	wasi := NewWASI(WithFS(noLstatFS{os.DirFS(root)}))
+	if _, errno := wasi.open(rootFD, "ok.txt", 0, 0, 0, libc.RightFdRead); errno != 0 {
+		t.Error("open ok.txt:", errno)
+	}
+	for _, name := range []string{"escape", "up/secret.txt"} {
+		if fd, errno := wasi.open(rootFD, name, libc.LookupflagSymlinkfollow, 0, 0, libc.RightFdRead); errno != libc.ErrnoNotcapable {
+			t.Error("open", name, "want:", libc.ErrnoNotcapable, "got:", fd, errno)
+		}
+		if _, errno := wasi.statAt(rootFD, name, true); errno != libc.ErrnoNotcapable {
+			t.Error("stat", name, "want:", libc.ErrnoNotcapable, "got:", errno)
+		}
+	}
+}
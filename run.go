@@ -0,0 +1,109 @@
+//go:build cgo
+
+package hammertime
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// from wasmtime.h, which wasmtime-go links in
+typedef struct wasmtime_store wasmtime_store_t;
+typedef struct wasmtime_context wasmtime_context_t;
+typedef struct wasmtime_error wasmtime_error_t;
+extern wasmtime_error_t *wasmtime_error_new(const char*);
+extern void wasmtime_store_epoch_deadline_callback(wasmtime_store_t*, wasmtime_error_t* (*)(wasmtime_context_t*, void*, uint64_t*), void*);
+
+// epochDeadline runs when a store reaches its epoch deadline.
+// It traps if the store's call was cancelled, and otherwise lets it continue until the next epoch.
+static wasmtime_error_t *epochDeadline(wasmtime_context_t *context, void *cancelled, uint64_t *delta) {
+	if (cancelled == NULL || __atomic_load_n((int32_t*)cancelled, __ATOMIC_SEQ_CST)) {
+		return wasmtime_error_new("interrupted");
+	}
+	*delta = 1;
+	return NULL;
+}
+
+static void setEpochDeadlineCallback(void *store, int32_t *cancelled) {
+	wasmtime_store_epoch_deadline_callback(store, epochDeadline, cancelled);
+}
+
+static void cancel(int32_t *cancelled) {
+	__atomic_store_n(cancelled, 1, __ATOMIC_SEQ_CST);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"unsafe"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+// Run calls the guest's _start function, stopping it when ctx is done. See Call.
+func (wasi *Instance) Run(ctx context.Context, store *wasmtime.Store, instance *wasmtime.Instance) error {
+	start := instance.GetFunc(store, "_start")
+	if start == nil {
+		return errors.New("hammertime: module has no _start function (use NewReactor for reactor modules)")
+	}
+	_, err := wasi.Call(ctx, store, start)
+	return err
+}
+
+// Call calls fn with the given arguments, stopping it when ctx is done.
+// If the context is cancelled or times out, ctx.Err() is returned instead of the resulting trap.
+//
+// Guest code is interrupted with epochs, so the store's engine must be created with
+// Config.SetEpochInterruption(true) for loops in the guest to be stopped.
+// Cancelling a call bumps the engine's epoch, but only the cancelled store traps:
+// calls made with Call in other stores keep running.
+// Stores running guest code some other way on the same engine with an epoch deadline set
+// are interrupted as usual.
+// Host calls waiting in fd_read on stdin or in poll_oneoff are always stopped.
+func (wasi *Instance) Call(ctx context.Context, store *wasmtime.Store, fn *wasmtime.Func, args ...any) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	wasi.ctx = ctx
+	defer func() { wasi.ctx = nil }()
+
+	cancelled := (*C.int32_t)(C.calloc(1, C.size_t(unsafe.Sizeof(C.int32_t(0)))))
+	C.setEpochDeadlineCallback(storePtr(store), cancelled)
+	defer func() {
+		// with no flag, the callback traps like wasmtime does without one
+		C.setEpochDeadlineCallback(storePtr(store), nil)
+		C.free(unsafe.Pointer(cancelled))
+		runtime.KeepAlive(store)
+	}()
+
+	store.SetEpochDeadline(1)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited // cancelled must outlive this goroutine
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			C.cancel(cancelled)
+			store.Engine.IncrementEpoch()
+		case <-done:
+		}
+	}()
+
+	result, err := fn.Call(store, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return result, err
+}
+
+// storePtr returns the store's wasmtime_store_t.
+// wasmtime-go doesn't expose it, but it's the first field of wasmtime.Store.
+func storePtr(store *wasmtime.Store) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(store))
+}
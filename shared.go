@@ -0,0 +1,68 @@
+package hammertime
+
+import (
+	"hash/fnv"
+	"reflect"
+	"sync"
+
+	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/exp/slices"
+)
+
+// sharedLocks serializes changes to filesystems, striped by filesystem identity.
+// Unrelated filesystems sometimes share a lock, and filesystems that aren't pointers
+// (or maps, channels, or slices) can't be told apart, so they all share lock 0.
+var sharedLocks [64]sync.Mutex
+
+// lockShared locks the filesystems containing the given paths against changes by other instances,
+// and returns a function that unlocks them.
+func (fsys *filesystem) lockShared(names ...string) (unlock func()) {
+	stripes := make([]int, 0, len(names))
+	for _, name := range names {
+		stripes = append(stripes, stripe(fsys.backing(name)))
+	}
+	// lock in order, to avoid deadlocks
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, i := range stripes {
+		sharedLocks[i].Lock()
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			sharedLocks[stripes[j]].Unlock()
+		}
+	}
+}
+
+// stripe picks the lock for fsys.
+// Host directories go by their top-level host directory rather than identity,
+// so that the same or nested directories mounted by different WASIs share a lock.
+func stripe(fsys hackpadfs.FS) int {
+	if hfs, ok := fsys.(*hostfs); ok {
+		h := fnv.New32a()
+		h.Write([]byte(hfs.top))
+		return int(h.Sum32() % uint32(len(sharedLocks)))
+	}
+	v := reflect.ValueOf(fsys)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Chan, reflect.Slice, reflect.UnsafePointer:
+		return int((v.Pointer() >> 4) % uintptr(len(sharedLocks)))
+	}
+	return 0
+}
+
+// backing returns the filesystem that actually contains name, looking through mounts.
+func (fsys *filesystem) backing(name string) hackpadfs.FS {
+	target := fsys.fs
+	for {
+		mfs, ok := target.(hackpadfs.MountFS)
+		if !ok {
+			return target
+		}
+		sub, subname := mfs.Mount(name)
+		if sub == target {
+			return target
+		}
+		target, name = sub, subname
+	}
+}
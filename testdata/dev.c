@@ -0,0 +1,31 @@
+#include <stdio.h>
+#include <errno.h>
+
+int main() {
+    FILE *out = fopen("/dev/stdout", "w");
+    if (!out) {
+        printf("oops! %d\n", errno);
+        return 1;
+    }
+    fprintf(out, "hello dev\n");
+    fclose(out);
+
+    FILE *null = fopen("/dev/null", "w");
+    if (!null) {
+        printf("oops! %d\n", errno);
+        return 1;
+    }
+    fprintf(null, "nobody sees this\n");
+    fclose(null);
+
+    FILE *zero = fopen("/dev/zero", "r");
+    if (!zero) {
+        printf("oops! %d\n", errno);
+        return 1;
+    }
+    unsigned char buf[4] = {1, 1, 1, 1};
+    fread(buf, 1, sizeof(buf), zero);
+    printf("%d %d %d %d\n", buf[0], buf[1], buf[2], buf[3]);
+    fclose(zero);
+    return 0;
+}
@@ -0,0 +1,24 @@
+#include <stdio.h>
+#include <fcntl.h>
+#include <unistd.h>
+#include <errno.h>
+
+int main() {
+    int dir = open("/subdir", O_RDONLY | O_DIRECTORY);
+    if (dir < 0) {
+        printf("oops! %d\n", errno);
+        return 1;
+    }
+    int fd = openat(dir, "a.txt", O_RDONLY);
+    if (fd < 0) {
+        printf("oops! %d\n", errno);
+        return 1;
+    }
+    char buf[32];
+    ssize_t n = read(fd, buf, sizeof(buf));
+    if (n > 0)
+        fwrite(buf, 1, n, stdout);
+    close(fd);
+    close(dir);
+    return 0;
+}
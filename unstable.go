@@ -0,0 +1,125 @@
+package hammertime
+
+import (
+	"io"
+	"unsafe"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+// snapshot0Module is the namespace of the legacy wasi_unstable (snapshot 0) functions,
+// still imported by binaries from older toolchains.
+const snapshot0Module = "wasi_unstable"
+
+// snapshot0 returns the wasi_unstable functions, given the preview1 ones.
+// Most are identical; the rest translate their arguments and results to and from preview1.
+func snapshot0(preview1 map[string]any) map[string]any {
+	symbols := maps.Clone(preview1)
+	symbols["fd_seek"] = (*Instance).fd_seek0
+	symbols["fd_filestat_get"] = (*Instance).fd_filestat_get0
+	symbols["path_filestat_get"] = (*Instance).path_filestat_get0
+	symbols["poll_oneoff"] = (*Instance).poll_oneoff0
+	return symbols
+}
+
+func (wasi *Instance) fd_seek0(caller guest, fd libc.Int, offset int64, whence, retptr libc.Int) (libc.Int, *trap) {
+	// whence is a u8, so don't let the conversion below wrap out-of-range values into valid ones
+	if whence < 0 || whence > libc.Int(libc.Whence0Set) {
+		return libc.ErrnoInval, nil
+	}
+	switch libc.Whence0(whence) {
+	case libc.Whence0Cur:
+		whence = io.SeekCurrent
+	case libc.Whence0End:
+		whence = io.SeekEnd
+	case libc.Whence0Set:
+		whence = io.SeekStart
+	default:
+		return libc.ErrnoInval, nil
+	}
+	return wasi.fd_seek(caller, fd, offset, whence, retptr)
+}
+
+func (wasi *Instance) fd_filestat_get0(caller guest, fd libc.Int, _retptr libc.Int) (libc.Int, *trap) {
+	retptr := libc.Ptr(_retptr)
+	size := libc.Size(unsafe.Sizeof(libc.Filestat0{}))
+
+	stat, errno := wasi.stat(fd)
+	if errno != 0 {
+		return errno, nil
+	}
+
+	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
+		*(*libc.Filestat0)(unsafe.Add(base, retptr)) = stat.Snapshot0()
+	}, retptr+size)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return libc.ErrnoSuccess, nil
+}
+
+func (wasi *Instance) path_filestat_get0(caller guest, fd, _lookupflags, _path, _pathlen, _retptr libc.Int) (libc.Int, *trap) {
+	flags := libc.Uint(_lookupflags)
+	path := libc.Ptr(_path)
+	pathlen := libc.Size(_pathlen)
+	retptr := libc.Ptr(_retptr)
+	wasi.debugln("path_filestat_get (snapshot 0)", fd, flags, path, pathlen, retptr)
+
+	size := libc.Size(unsafe.Sizeof(libc.Filestat0{}))
+
+	var errno libc.Errno
+	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
+		name := string(data[path : path+pathlen])
+		var stat *libc.Filestat
+		stat, errno = wasi.statAt(fd, name, flags&libc.LookupflagSymlinkfollow != 0)
+		wasi.debugf("stat(%d, %q, %o) → %d", fd, name, flags, errno)
+		if errno != libc.ErrnoSuccess {
+			return
+		}
+		*(*libc.Filestat0)(unsafe.Add(base, retptr)) = stat.Snapshot0()
+	}, path+pathlen, retptr+size)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return errno, nil
+}
+
+func (wasi *Instance) poll_oneoff0(caller guest, _in, _out, _nsubs, _retptr libc.Int) (libc.Int, *trap) {
+	in := libc.Ptr(_in)
+	out := libc.Ptr(_out)
+	nsubs := libc.Size(_nsubs)
+	retptr := libc.Ptr(_retptr)
+	wasi.debugln("poll_oneoff (snapshot 0)", in, out, nsubs, retptr)
+
+	if nsubs == 0 {
+		return libc.ErrnoInval, nil
+	}
+	subsize := libc.Size(unsafe.Sizeof(libc.Subscription0{}))
+	var subs []libc.Subscription
+	err := ensure(caller, func(base unsafe.Pointer, _ []byte) {
+		for _, sub := range unsafe.Slice((*libc.Subscription0)(unsafe.Add(base, in)), nsubs) {
+			subs = append(subs, sub.Preview1())
+		}
+	}, in+subsize*nsubs)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+
+	events, trap := wasi.poll(caller, subs)
+	if trap != nil {
+		return 0, trap
+	}
+
+	// events have the same layout in both
+	evsize := libc.Size(unsafe.Sizeof(libc.Event{}))
+	err = ensure(caller, func(base unsafe.Pointer, _ []byte) {
+		copy(unsafe.Slice((*libc.Event)(unsafe.Add(base, out)), len(events)), events)
+		*(*libc.Size)(unsafe.Add(base, retptr)) = libc.Size(len(events))
+	}, out+evsize*libc.Size(len(events)), retptr+libc.PtrSize)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return libc.ErrnoSuccess, nil
+}
@@ -0,0 +1,216 @@
+package hammertime
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// VirtualFile is a file whose contents are provided by the host.
+// Each time the guest opens it, a fresh in-memory copy is used.
+type VirtualFile struct {
+	// Read is called when the file is opened and returns its contents.
+	// If nil, the file starts out empty.
+	Read func() ([]byte, error)
+	// Write is called when a file that was opened for writing is closed,
+	// and receives the final contents of the file.
+	// If nil, the file is read-only.
+	Write func([]byte) error
+	// Mode is the file's permission bits. Defaults to 0644, or 0444 if Write is nil.
+	Mode fs.FileMode
+	// ModTime is reported as the file's modification time.
+	ModTime time.Time
+}
+
+func (vf *VirtualFile) info(name string, size int64) fileinfo {
+	mode := vf.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+		if vf.Write == nil {
+			mode = 0444
+		}
+	}
+	return fileinfo{
+		name:    name,
+		size:    size,
+		mode:    mode,
+		modTime: vf.ModTime,
+	}
+}
+
+// VirtualFS is a flat directory of virtual files, keyed by file name.
+// Mount it with WithMount.
+type VirtualFS map[string]*VirtualFile
+
+// Open implements fs.FS.
+func (vfs VirtualFS) Open(name string) (fs.File, error) {
+	return vfs.OpenFile(name, hackpadfs.FlagReadOnly, 0)
+}
+
+// OpenFile implements hackpadfs.OpenFileFS.
+func (vfs VirtualFS) OpenFile(name string, flag int, _ fs.FileMode) (hackpadfs.File, error) {
+	if name == "." {
+		names := maps.Keys(vfs)
+		slices.Sort(names)
+		ents := make([]fs.DirEntry, 0, len(names))
+		for _, name := range names {
+			ents = append(ents, fs.FileInfoToDirEntry(vfs[name].info(name, 0)))
+		}
+		return &vdir{info: dirinfo("."), entries: ents}, nil
+	}
+
+	vf, ok := vfs[name]
+	if !ok {
+		if flag&hackpadfs.FlagCreate != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if flag&hackpadfs.FlagCreate != 0 && flag&hackpadfs.FlagExclusive != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	writable := flag&(hackpadfs.FlagWriteOnly|hackpadfs.FlagReadWrite) != 0
+	if writable && vf.Write == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	f := &vfile{
+		name:     name,
+		vf:       vf,
+		writable: writable,
+	}
+	if vf.Read != nil && flag&hackpadfs.FlagTruncate == 0 {
+		data, err := vf.Read()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w: %v", syscall.EIO, err)}
+		}
+		f.data = slices.Clone(data)
+	}
+	if flag&hackpadfs.FlagTruncate != 0 {
+		f.dirty = writable
+	}
+	if flag&hackpadfs.FlagAppend != 0 {
+		f.pos = int64(len(f.data))
+	}
+	return f, nil
+}
+
+// Stat implements hackpadfs.StatFS.
+// The file's size is only known once it has been opened, so it is reported as zero.
+func (vfs VirtualFS) Stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return dirinfo("."), nil
+	}
+	vf, ok := vfs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return vf.info(name, 0), nil
+}
+
+// vfile is an open VirtualFile.
+type vfile struct {
+	name     string
+	vf       *VirtualFile
+	data     []byte
+	pos      int64
+	writable bool
+	dirty    bool
+	closed   bool
+}
+
+func (f *vfile) Stat() (fs.FileInfo, error) {
+	return f.vf.info(f.name, int64(len(f.data))), nil
+}
+
+func (f *vfile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *vfile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *vfile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *vfile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	f.dirty = true
+	return copy(f.data[off:], p), nil
+}
+
+func (f *vfile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *vfile) Truncate(size int64) error {
+	if !f.writable {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.dirty = true
+	return nil
+}
+
+// Close delivers the written contents to the host.
+func (f *vfile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	if !f.writable || !f.dirty {
+		return nil
+	}
+	if err := f.vf.Write(f.data); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fmt.Errorf("%w: %v", syscall.EIO, err)}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package hammertime
+
+import (
+	"io"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+
+	"github.com/guregu/hammertime/libc"
+)
+
+func TestVirtualFile(t *testing.T) {
+	var result []byte
+	wasi := NewWASI(
+		WithMount("/run", VirtualFS{
+			"config.json": &VirtualFile{
+				Read: func() ([]byte, error) {
+					return []byte(`{"ok":true}`), nil
+				},
+			},
+			"result": &VirtualFile{
+				Write: func(data []byte) error {
+					result = data
+					return nil
+				},
+			},
+		}),
+	)
+
+	fd, errno := wasi.open(rootFD, "/run/config.json", 0, 0, 0, libc.RightFdRead)
+	if errno != 0 {
+		t.Fatal("open config", errno)
+	}
+	stat, errno := wasi.stat(fd)
+	if errno != 0 {
+		t.Fatal("stat", errno)
+	}
+	if stat.Size != 11 {
+		t.Error("bad size. want: 11 got:", stat.Size)
+	}
+	f, _ := wasi.get(fd)
+	if _, err := hackpadfs.SeekFile(f.File, 1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"ok":true}` {
+		t.Error("bad read. got:", string(data))
+	}
+	if errno := wasi.close(fd); errno != 0 {
+		t.Error("close", errno)
+	}
+
+	if _, errno := wasi.open(rootFD, "/run/config.json", 0, 0, 0, libc.RightFdWrite); errno != libc.ErrnoPerm {
+		t.Error("bad errno opening read-only virtual file for writing. want:", libc.ErrnoPerm, "got:", errno)
+	}
+
+	fd, errno = wasi.open(rootFD, "/run/result", 0, libc.OflagTrunc, 0, libc.RightFdWrite)
+	if errno != 0 {
+		t.Fatal("open result", errno)
+	}
+	f, _ = wasi.get(fd)
+	f.Write([]byte("done"))
+	if result != nil {
+		t.Error("result delivered before close")
+	}
+	if errno := wasi.close(fd); errno != 0 {
+		t.Error("close", errno)
+	}
+	if string(result) != "done" {
+		t.Error("bad result. want: done got:", string(result))
+	}
+}
@@ -1,137 +1,182 @@
 package hammertime
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"sync"
 	"unsafe"
 
-	"github.com/bytecodealliance/wasmtime-go/v11"
 	"github.com/hack-pad/hackpadfs"
+	"golang.org/x/exp/slices"
 
 	"github.com/guregu/hammertime/libc"
 )
 
+// preview1Module is the namespace of the WASI preview1 functions.
+const preview1Module = "wasi_snapshot_preview1"
+
 // WASI is a WASI environment.
+// Its configuration is fixed once created, and it can be linked once and instantiated many times,
+// with NewInstance creating fresh state (open files, working directory, and so on) for each store.
 type WASI struct {
+	config
+
+	// Instance is the default instance, used by Link.
+	*Instance
+	err error // setting up the default instance, returned by Link
+
+	instances sync.Map // store context → *Instance
+}
+
+// config is the immutable configuration of a WASI, shared by all of its instances.
+type config struct {
 	args    charbuffer
 	environ charbuffer
-	filesystem
-	clock Clock
+	clock   Clock
 
-	// config
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
+	random io.Reader
 	env    map[string]string
 	debug  bool
+
+	root     fs.FS
+	policy   Policy
+	devices  bool
+	mounts   []mountpoint
+	workdir  string
+	chdirext bool
+	limits   Limits
+	modes    perms
+	zoneinfo fs.FS
 }
 
 // NewWASI creates a new WASI environment.
-// Currently they may not be shared between instances.
 func NewWASI(opts ...Option) *WASI {
 	wasi := new(WASI)
 	for _, opt := range opts {
 		opt(wasi)
 	}
+	wasi.setup()
+	wasi.Instance, wasi.err = wasi.newInstance(&wasi.config)
+	return wasi
+}
+
+// setup fills in defaults after options have been applied.
+func (wasi *WASI) setup() {
+	if wasi.clock == nil {
+		wasi.clock = SystemClock
+	}
+	if _, ok := wasi.env["TZ"]; !ok && wasi.zoneinfo != nil {
+		if wasi.env == nil {
+			wasi.env = make(map[string]string)
+		}
+		wasi.env["TZ"] = tzenv(wasi.clock, wasi.zoneinfo)
+	}
 	wasi.environ = make(charbuffer, len(wasi.env))
 	for k, v := range wasi.env {
 		wasi.environ = append(wasi.environ, fmt.Sprintf("%s=%s", k, v))
 	}
-	if wasi.clock == nil {
-		wasi.clock = SystemClock
+	if wasi.random == nil {
+		wasi.random = rand.Reader
 	}
-	wasi.filesystem = *newFilesystem(wasi.fs, wasi.stdin, wasi.stdout, wasi.stderr)
-	return wasi
 }
 
-// Link defines all (supported) WASI functions on the given linker.
-func (wasi *WASI) Link(store wasmtime.Storelike, linker *wasmtime.Linker) error {
-	const mod = "wasi_snapshot_preview1"
-	symbols := map[string]any{
-		"args_sizes_get":        wasi.args_sizes_get,
-		"args_get":              wasi.args_get,
-		"environ_sizes_get":     wasi.environ_sizes_get,
-		"environ_get":           wasi.environ_get,
-		"clock_time_get":        wasi.clock_time_get,
-		"fd_close":              wasi.fd_close,
-		"fd_fdstat_get":         wasi.fd_fdstat_get,
-		"fd_fdstat_set_flags":   wasi.fd_fdstat_set_flags,
-		"fd_prestat_get":        wasi.fd_prestat_get,
-		"fd_prestat_dir_name":   wasi.fd_prestat_dir_name,
-		"fd_filestat_get":       wasi.fd_filestat_get,
-		"fd_seek":               wasi.fd_seek,
-		"fd_write":              wasi.fd_write,
-		"fd_read":               wasi.fd_read,
-		"fd_pread":              wasi.fd_pread,
-		"fd_readdir":            wasi.fd_readdir,
-		"path_open":             wasi.path_open,
-		"path_filestat_get":     wasi.path_filestat_get,
-		"path_readlink":         wasi.path_readlink,
-		"path_rename":           wasi.path_rename,
-		"path_create_directory": wasi.path_create_directory,
-		"path_remove_directory": wasi.path_remove_directory,
-		"path_unlink_file":      wasi.path_unlink_file,
-		"poll_oneoff":           wasi.poll_oneoff,
-		"proc_exit":             wasi.proc_exit,
-	}
-	for name, fn := range symbols {
-		if err := linker.DefineFunc(store, mod, name, fn); err != nil {
-			return err
+// modules returns the host functions to define, by module name, as method expressions of Instance.
+func (wasi *WASI) modules() map[string]map[string]any {
+	modules := map[string]map[string]any{
+		preview1Module: {
+			"args_sizes_get":        (*Instance).args_sizes_get,
+			"args_get":              (*Instance).args_get,
+			"environ_sizes_get":     (*Instance).environ_sizes_get,
+			"environ_get":           (*Instance).environ_get,
+			"clock_time_get":        (*Instance).clock_time_get,
+			"fd_close":              (*Instance).fd_close,
+			"fd_fdstat_get":         (*Instance).fd_fdstat_get,
+			"fd_fdstat_set_flags":   (*Instance).fd_fdstat_set_flags,
+			"fd_prestat_get":        (*Instance).fd_prestat_get,
+			"fd_prestat_dir_name":   (*Instance).fd_prestat_dir_name,
+			"fd_filestat_get":       (*Instance).fd_filestat_get,
+			"fd_seek":               (*Instance).fd_seek,
+			"fd_write":              (*Instance).fd_write,
+			"fd_read":               (*Instance).fd_read,
+			"fd_pread":              (*Instance).fd_pread,
+			"fd_readdir":            (*Instance).fd_readdir,
+			"path_open":             (*Instance).path_open,
+			"path_filestat_get":     (*Instance).path_filestat_get,
+			"path_readlink":         (*Instance).path_readlink,
+			"path_rename":           (*Instance).path_rename,
+			"path_create_directory": (*Instance).path_create_directory,
+			"path_remove_directory": (*Instance).path_remove_directory,
+			"path_unlink_file":      (*Instance).path_unlink_file,
+			"poll_oneoff":           (*Instance).poll_oneoff,
+			"proc_exit":             (*Instance).proc_exit,
+			"random_get":            (*Instance).random_get,
+		},
+	}
+	modules[snapshot0Module] = snapshot0(modules[preview1Module])
+	if wasi.chdirext {
+		modules[wasixModule] = map[string]any{
+			"getcwd": (*Instance).getcwd,
+			"chdir":  (*Instance).chdir_,
 		}
 	}
-	return nil
+	return modules
 }
 
-func (wasi *WASI) args_sizes_get(caller *wasmtime.Caller, argc, argv libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) args_sizes_get(caller guest, argc, argv libc.Int) (libc.Int, *trap) {
 	wasi.debugln("args_sizes_get", argc, argv)
 
 	err := wasi.args.writeSizes(caller, argc, argv)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) environ_sizes_get(caller *wasmtime.Caller, argc, argv libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) environ_sizes_get(caller guest, argc, argv libc.Int) (libc.Int, *trap) {
 	wasi.debugln("environ_sizes_get", argc, argv)
 
 	err := wasi.environ.writeSizes(caller, argc, argv)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) args_get(caller *wasmtime.Caller, argv, argbuf libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) args_get(caller guest, argv, argbuf libc.Int) (libc.Int, *trap) {
 	wasi.debugln("args_get", argv, argbuf)
 
 	if err := wasi.args.write(caller, argv, argbuf); err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) environ_get(caller *wasmtime.Caller, argv, argbuf libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) environ_get(caller guest, argv, argbuf libc.Int) (libc.Int, *trap) {
 	wasi.debugln("environ_get", argv, argbuf)
 
 	err := wasi.environ.write(caller, argv, argbuf)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_close(caller *wasmtime.Caller, fd libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_close(caller guest, fd libc.Int) (libc.Int, *trap) {
 	wasi.debugln("fd_close", fd)
 	errno := wasi.close(fd)
 	return errno, nil
 }
 
-func (wasi *WASI) fd_fdstat_get(caller *wasmtime.Caller, fd, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_fdstat_get(caller guest, fd, _retptr libc.Int) (libc.Int, *trap) {
 	retptr := libc.Ptr(_retptr)
 	wasi.debugln("fd_fdstat_get", fd, retptr)
 
@@ -150,7 +195,7 @@ func (wasi *WASI) fd_fdstat_get(caller *wasmtime.Caller, fd, _retptr libc.Int) (
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_seek(caller *wasmtime.Caller, fd libc.Int, offset int64, whence, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_seek(caller guest, fd libc.Int, offset int64, whence, _retptr libc.Int) (libc.Int, *trap) {
 	retptr := libc.Ptr(_retptr)
 	wasi.debugf("seek(%d, %d, %d)", fd, offset, whence)
 	f, errno := wasi.get(fd)
@@ -167,13 +212,13 @@ func (wasi *WASI) fd_seek(caller *wasmtime.Caller, fd libc.Int, offset int64, wh
 		*(*int64)(unsafe.Add(base, retptr)) = ret
 	}, retptr+8)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_write(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_write(caller guest, fd, _iovs, _iovslen, _retptr libc.Int) (libc.Int, *trap) {
 	iovs := libc.Ptr(_iovs)
 	iovslen := libc.Size(_iovslen)
 	retptr := libc.Ptr(_retptr)
@@ -196,26 +241,35 @@ func (wasi *WASI) fd_write(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				errno = libc.Error(err)
+				if total == 0 {
+					errno = libc.Error(err)
+				}
+				break
+			}
+			if wrote < len(buf) {
+				// short write, report what we have so far
 				break
 			}
 		}
 		*(*libc.Size)(unsafe.Add(base, retptr)) = total
 	}, iovs+vecsize*iovslen, retptr+libc.PtrSize)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 	return errno, nil
 }
 
-func (wasi *WASI) proc_exit(caller *wasmtime.Caller, code libc.Int) *wasmtime.Trap {
+func (wasi *Instance) proc_exit(caller guest, code libc.Int) *trap {
+	wasi.filesystem.mu.Lock()
+	wasi.exited, wasi.code = true, code
+	wasi.filesystem.mu.Unlock()
 	if code > 0 {
-		return wasmtime.NewTrap(fmt.Sprintf("exit: %d", code))
+		return newTrap(fmt.Sprintf("exit: %d", code))
 	}
 	return nil
 }
 
-func (wasi *WASI) clock_time_get(caller *wasmtime.Caller, clockid libc.Int, resolution int64, _tsptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) clock_time_get(caller guest, clockid libc.Int, resolution int64, _tsptr libc.Int) (libc.Int, *trap) {
 	tsptr := libc.Ptr(_tsptr)
 	wasi.debugln("clock_time_get", clockid, resolution, tsptr)
 
@@ -225,18 +279,18 @@ func (wasi *WASI) clock_time_get(caller *wasmtime.Caller, clockid libc.Int, reso
 		*(*int64)(unsafe.Add(base, tsptr)) = wasi.clock.Now().UnixNano()
 	}, tsptr+8)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_fdstat_set_flags(caller *wasmtime.Caller, fd libc.Int, flags libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_fdstat_set_flags(caller guest, fd libc.Int, flags libc.Int) (libc.Int, *trap) {
 	wasi.debugf("fd_fdstat_set_flags(%d, %o)", fd, flags)
 	return libc.ErrnoNosys, nil
 }
 
-func (wasi *WASI) fd_prestat_get(caller *wasmtime.Caller, fd libc.Int, _prestat libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_prestat_get(caller guest, fd libc.Int, _prestat libc.Int) (libc.Int, *trap) {
 	prestat := libc.Ptr(_prestat)
 	wasi.debugln("fd_prestat_get", fd, prestat)
 
@@ -257,13 +311,13 @@ func (wasi *WASI) fd_prestat_get(caller *wasmtime.Caller, fd libc.Int, _prestat
 		*(*libc.PrestatDir)(unsafe.Add(base, prestat)) = dir
 	}, prestat+libc.Size(unsafe.Sizeof(dir)))
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_prestat_dir_name(caller *wasmtime.Caller, fd, _buf, _len libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_prestat_dir_name(caller guest, fd, _buf, _len libc.Int) (libc.Int, *trap) {
 	buf := libc.Ptr(_buf)
 	len := libc.Size(_len)
 	wasi.debugln("fd_prestat_dir_name", fd, buf, len)
@@ -280,13 +334,13 @@ func (wasi *WASI) fd_prestat_dir_name(caller *wasmtime.Caller, fd, _buf, _len li
 		copy(data[buf:buf+len], []byte(f.preopen))
 	}, buf+len)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) fd_read(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_read(caller guest, fd, _iovs, _iovslen, _retptr libc.Int) (libc.Int, *trap) {
 	iovs := libc.Ptr(_iovs)
 	iovslen := libc.Size(_iovslen)
 	retptr := libc.Ptr(_retptr)
@@ -297,6 +351,7 @@ func (wasi *WASI) fd_read(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr
 		return errno, nil
 	}
 
+	stream, isStream := f.File.(*stream)
 	vecsize := libc.Size(unsafe.Sizeof(libc.Ciovec{}))
 	var total libc.Size
 	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
@@ -304,11 +359,21 @@ func (wasi *WASI) fd_read(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr
 		vecs := unsafe.Slice(vec0, iovslen)
 		for _, vec := range vecs {
 			buf := data[vec.Buf+total : vec.Buf+vec.Len]
-			read, err := f.Read(buf)
+			var read int
+			var err error
+			if isStream {
+				// stdin might block forever
+				read, err = stream.readContext(wasi.callContext(caller), buf)
+			} else {
+				read, err = f.Read(buf)
+			}
 			total += libc.Size(read)
 			wasi.debugf("read(%d, %q, %d)", fd, string(buf[:read]), total)
 			if err == io.EOF {
 				break
+			} else if isStream && wasi.interrupted(caller) != nil {
+				// cancelled, not an I/O error: trap below
+				break
 			} else if err != nil {
 				errno = libc.Error(err)
 				break
@@ -317,12 +382,15 @@ func (wasi *WASI) fd_read(caller *wasmtime.Caller, fd, _iovs, _iovslen, _retptr
 		*(*libc.Size)(unsafe.Add(base, retptr)) = total
 	}, iovs+vecsize*iovslen, retptr+libc.PtrSize)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
+	}
+	if trap := wasi.interrupted(caller); trap != nil {
+		return 0, trap
 	}
 	return errno, nil
 }
 
-func (wasi *WASI) fd_pread(caller *wasmtime.Caller, fd, _iovs, _iovslen libc.Int, _offset int64, _retptr libc.Int) (errno int32, trap *wasmtime.Trap) {
+func (wasi *Instance) fd_pread(caller guest, fd, _iovs, _iovslen libc.Int, _offset int64, _retptr libc.Int) (errno int32, trap *trap) {
 	iovs := libc.Ptr(_iovs)
 	iovslen := libc.Size(_iovslen)
 	offset := uint64(_offset)
@@ -376,13 +444,13 @@ func (wasi *WASI) fd_pread(caller *wasmtime.Caller, fd, _iovs, _iovslen libc.Int
 		*(*libc.Size)(unsafe.Add(base, retptr)) = total
 	}, iovs+vecsize*iovslen, retptr+libc.PtrSize)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) fd_readdir(caller *wasmtime.Caller, fd, _buf, _buflen libc.Int, cookie int64, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_readdir(caller guest, fd, _buf, _buflen libc.Int, cookie int64, _retptr libc.Int) (libc.Int, *trap) {
 	buf := libc.Ptr(_buf)
 	buflen := libc.Size(_buflen)
 	retptr := libc.Ptr(_retptr) // buffer consumed
@@ -413,13 +481,13 @@ func (wasi *WASI) fd_readdir(caller *wasmtime.Caller, fd, _buf, _buflen libc.Int
 		*(*libc.Size)(unsafe.Add(base, retptr)) = wrote
 	}, buf+buflen, retptr+libc.PtrSize)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) path_open(caller *wasmtime.Caller, fd, _dirflags, _pathptr, _pathlen, _oflags int32, _fsrights_base, _fsrights_inheriting int64, _fdflags, _retptr int32) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_open(caller guest, fd, _dirflags, _pathptr, _pathlen, _oflags int32, _fsrights_base, _fsrights_inheriting int64, _fdflags, _retptr int32) (libc.Int, *trap) {
 	dirflags := libc.Lookupflag(_dirflags)
 	pathptr := libc.Ptr(_pathptr)
 	pathlen := libc.Size(_pathlen)
@@ -438,29 +506,29 @@ func (wasi *WASI) path_open(caller *wasmtime.Caller, fd, _dirflags, _pathptr, _p
 		wasi.debugf("open(%d, %q, %o, %o, %o) → %d", fd, path, oflags, fdflags, rights, errno)
 	}, pathptr+pathlen, retptr+libc.PtrSize)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 	return errno, nil
 }
 
-func (wasi *WASI) path_create_directory(caller *wasmtime.Caller, fd, _path, _pathlen int32) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_create_directory(caller guest, fd, _path, _pathlen int32) (libc.Int, *trap) {
 	path := libc.Ptr(_path)
 	pathlen := libc.Size(_pathlen)
 
 	var errno libc.Errno
 	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
 		name := string(data[path : path+pathlen])
-		errno = wasi.mkdir(fd, name, mkdirMode) // TODO: mkdirat
+		errno = wasi.mkdir(fd, name) // TODO: mkdirat
 		wasi.debugf("mkdir(%d, %q)", fd, name)
 	}, path+pathlen)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) path_remove_directory(caller *wasmtime.Caller, fd, _path, _pathlen int32) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_remove_directory(caller guest, fd, _path, _pathlen int32) (libc.Int, *trap) {
 	path := libc.Ptr(_path)
 	pathlen := libc.Size(_pathlen)
 
@@ -471,13 +539,13 @@ func (wasi *WASI) path_remove_directory(caller *wasmtime.Caller, fd, _path, _pat
 		wasi.debugf("rmdir(%d, %q)", fd, name) // TODO: fd
 	}, path+pathlen)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) path_unlink_file(caller *wasmtime.Caller, fd int32, _path, _pathlen int32) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_unlink_file(caller guest, fd int32, _path, _pathlen int32) (libc.Int, *trap) {
 	path := libc.Ptr(_path)
 	pathlen := libc.Size(_pathlen)
 
@@ -488,13 +556,13 @@ func (wasi *WASI) path_unlink_file(caller *wasmtime.Caller, fd int32, _path, _pa
 		wasi.debugf("unlink(%d, %q)", fd, name)
 	}, path+pathlen)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) fd_filestat_get(caller *wasmtime.Caller, fd libc.Int, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) fd_filestat_get(caller guest, fd libc.Int, _retptr libc.Int) (libc.Int, *trap) {
 	retptr := libc.Ptr(_retptr)
 	size := libc.Size(unsafe.Sizeof(libc.Filestat{}))
 
@@ -507,12 +575,12 @@ func (wasi *WASI) fd_filestat_get(caller *wasmtime.Caller, fd libc.Int, _retptr
 		*(*libc.Filestat)(unsafe.Add(base, retptr)) = *stat
 	}, retptr+size)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 	return libc.ErrnoSuccess, nil
 }
 
-func (wasi *WASI) path_filestat_get(caller *wasmtime.Caller, fd, _lookupflags, _path, _pathlen, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_filestat_get(caller guest, fd, _lookupflags, _path, _pathlen, _retptr libc.Int) (libc.Int, *trap) {
 	flags := libc.Uint(_lookupflags)
 	path := libc.Ptr(_path)
 	pathlen := libc.Size(_pathlen)
@@ -521,23 +589,24 @@ func (wasi *WASI) path_filestat_get(caller *wasmtime.Caller, fd, _lookupflags, _
 
 	size := libc.Size(unsafe.Sizeof(libc.Filestat{}))
 
-	stat, errno := wasi.stat(fd)
-	if errno != 0 {
-		return errno, nil
-	}
-
+	var errno libc.Errno
 	err := ensure(caller, func(base unsafe.Pointer, data []byte) {
-		name := data[path : path+pathlen]
-		wasi.debugf("stat(%d, %q, %o)", fd, name, flags)
+		name := string(data[path : path+pathlen])
+		var stat *libc.Filestat
+		stat, errno = wasi.statAt(fd, name, flags&libc.LookupflagSymlinkfollow != 0)
+		wasi.debugf("stat(%d, %q, %o) → %d", fd, name, flags, errno)
+		if errno != libc.ErrnoSuccess {
+			return
+		}
 		*(*libc.Filestat)(unsafe.Add(base, retptr)) = *stat
 	}, path+pathlen, retptr+size)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
-	return libc.ErrnoSuccess, nil
+	return errno, nil
 }
 
-func (wasi *WASI) path_readlink(caller *wasmtime.Caller, fd, _path, _pathlen, _bufptr, _buflen, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_readlink(caller guest, fd, _path, _pathlen, _bufptr, _buflen, _retptr libc.Int) (libc.Int, *trap) {
 	path := libc.Ptr(_path)
 	pathlen := libc.Size(_pathlen)
 	bufptr := libc.Ptr(_bufptr)
@@ -557,13 +626,13 @@ func (wasi *WASI) path_readlink(caller *wasmtime.Caller, fd, _path, _pathlen, _b
 		*(*libc.Size)(unsafe.Add(base, retptr)) = size
 	}, path+pathlen, bufptr+buflen)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) path_rename(caller *wasmtime.Caller, fd, _oldpath, _oldpathlen, _newfdptr, _newpath, _newpathlen libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) path_rename(caller guest, fd, _oldpath, _oldpathlen, _newfdptr, _newpath, _newpathlen libc.Int) (libc.Int, *trap) {
 	oldpath := libc.Ptr(_oldpath)
 	oldpathlen := libc.Size(_oldpathlen)
 	newfd := libc.Ptr(_newfdptr)
@@ -583,29 +652,73 @@ func (wasi *WASI) path_rename(caller *wasmtime.Caller, fd, _oldpath, _oldpathlen
 		*(*libc.Int)(unsafe.Add(base, newfd)) = fd // TODO
 	}, oldpath+oldpathlen, newpath+newpathlen, newfd)
 	if err != nil {
-		return 0, wasmtime.NewTrap(err.Error())
+		return 0, newTrap(err.Error())
 	}
 
 	return errno, nil
 }
 
-func (wasi *WASI) poll_oneoff(caller *wasmtime.Caller, _in, _out, _nsubs, _retptr libc.Int) (libc.Int, *wasmtime.Trap) {
+func (wasi *Instance) poll_oneoff(caller guest, _in, _out, _nsubs, _retptr libc.Int) (libc.Int, *trap) {
 	in := libc.Ptr(_in)
 	out := libc.Ptr(_out)
 	nsubs := libc.Size(_nsubs)
 	retptr := libc.Ptr(_retptr)
 	wasi.debugln("poll_oneoff", in, out, nsubs, retptr)
-	return libc.ErrnoNosys, nil
+
+	if nsubs == 0 {
+		return libc.ErrnoInval, nil
+	}
+	subsize := libc.Size(unsafe.Sizeof(libc.Subscription{}))
+	var subs []libc.Subscription
+	err := ensure(caller, func(base unsafe.Pointer, _ []byte) {
+		subs = slices.Clone(unsafe.Slice((*libc.Subscription)(unsafe.Add(base, in)), nsubs))
+	}, in+subsize*nsubs)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+
+	events, trap := wasi.poll(caller, subs)
+	if trap != nil {
+		return 0, trap
+	}
+
+	evsize := libc.Size(unsafe.Sizeof(libc.Event{}))
+	err = ensure(caller, func(base unsafe.Pointer, _ []byte) {
+		copy(unsafe.Slice((*libc.Event)(unsafe.Add(base, out)), len(events)), events)
+		*(*libc.Size)(unsafe.Add(base, retptr)) = libc.Size(len(events))
+	}, out+evsize*libc.Size(len(events)), retptr+libc.PtrSize)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+	return libc.ErrnoSuccess, nil
+}
+
+func (wasi *Instance) random_get(caller guest, _buf, _buflen libc.Int) (libc.Int, *trap) {
+	buf := libc.Ptr(_buf)
+	buflen := libc.Size(_buflen)
+	wasi.debugln("random_get", buf, buflen)
+
+	var errno libc.Errno
+	err := ensure(caller, func(_ unsafe.Pointer, data []byte) {
+		if _, err := io.ReadFull(wasi.random, data[buf:buf+buflen]); err != nil {
+			errno = libc.ErrnoIo
+		}
+	}, buf+buflen)
+	if err != nil {
+		return 0, newTrap(err.Error())
+	}
+
+	return errno, nil
 }
 
-func (wasi *WASI) debugln(args ...any) {
+func (wasi *config) debugln(args ...any) {
 	if !wasi.debug {
 		return
 	}
 	log.Println(args...)
 }
 
-func (wasi *WASI) debugf(fmt string, args ...any) {
+func (wasi *config) debugf(fmt string, args ...any) {
 	if !wasi.debug {
 		return
 	}
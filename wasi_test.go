@@ -1,15 +1,28 @@
+//go:build cgo
+
 package hammertime
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bytecodealliance/wasmtime-go/v11"
-	hpos "github.com/hack-pad/hackpadfs/os"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/tetratelabs/wazero"
+
+	"github.com/guregu/hammertime/libc"
 	// _ "github.com/benesch/cgosymbolizer"
 )
 
@@ -28,6 +41,8 @@ func TestWASI(t *testing.T) {
 		{"dir.wasm", "a.txt\nb.txt\n"},
 		{"echo.wasm", stdinText},
 		{"mkdir.wasm", "a 0 0\nb 0 0\nc 0 0\nd 0 0\n"},
+		{"dev.wasm", "hello dev\n0 0 0 0\n"},
+		{"openat.wasm", "hello\n"},
 	}
 
 	for _, testcase := range cases {
@@ -47,14 +62,6 @@ func TestWASI(t *testing.T) {
 			stdin := strings.NewReader(stdinText)
 			stdout := new(bytes.Buffer)
 			stderr := new(bytes.Buffer)
-			dir, err := filepath.Abs("testdata")
-			if err != nil {
-				t.Fatal(err)
-			}
-			dirfs, err := hpos.NewFS().Sub(dir[1:])
-			if err != nil {
-				t.Fatal(err)
-			}
 			wasi := NewWASI(
 				WithArgs([]string{"hello", "world"}),
 				WithEnv(map[string]string{"TEST": "it works"}),
@@ -62,7 +69,8 @@ func TestWASI(t *testing.T) {
 				WithStdin(stdin),
 				WithStdout(stdout),
 				WithStderr(stderr),
-				WithFS(dirfs),
+				WithHostDir("/", "testdata", DirReadWrite),
+				WithDevices(true),
 				WithDebug(true),
 			)
 			if err := wasi.Link(store, linker); err != nil {
@@ -84,3 +92,391 @@ func TestWASI(t *testing.T) {
 		})
 	}
 }
+
+func TestInstances(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_close" (func $close (param i32) (result i32)))
+		(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+		(memory (export "memory") 1)
+		(func (export "close") (param i32) (result i32) (call $close (local.get 0)))
+		(func (export "exit") (param i32) (call $exit (local.get 0))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "a.txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := wasmtime.NewEngine()
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	wasi := NewWASI(WithFS(memfs))
+	if err := wasi.Define(linker); err != nil {
+		t.Fatal(err)
+	}
+
+	type run struct {
+		store    *wasmtime.Store
+		inst     *Instance
+		instance *wasmtime.Instance
+	}
+	runs := make([]run, 3)
+	for i := range runs {
+		store := wasmtime.NewStore(engine)
+		var inst *Instance
+		if i < 2 {
+			if inst, err = wasi.NewInstance(store); err != nil {
+				t.Fatal(err)
+			}
+		}
+		instance, err := linker.Instantiate(store, module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[i] = run{store: store, inst: inst, instance: instance}
+	}
+
+	fd, errno := runs[0].inst.open(rootFD, "a.txt", 0, 0, 0, libc.RightFdRead)
+	if errno != 0 {
+		t.Fatal("open", errno)
+	}
+	closefd := func(r run) (any, error) {
+		return r.instance.GetFunc(r.store, "close").Call(r.store, fd)
+	}
+	if got, err := closefd(runs[1]); err != nil || got != int32(libc.ErrnoBadf) {
+		t.Error("other instance's fd: want:", libc.ErrnoBadf, "got:", got, err)
+	}
+	if got, err := closefd(runs[0]); err != nil || got != int32(libc.ErrnoSuccess) {
+		t.Error("close: want:", libc.ErrnoSuccess, "got:", got, err)
+	}
+	if _, err := closefd(runs[2]); err == nil {
+		t.Error("expected trap for store without an instance")
+	}
+
+	if _, err := runs[0].instance.GetFunc(runs[0].store, "exit").Call(runs[0].store, 3); err == nil {
+		t.Error("expected exit trap")
+	}
+	if code, exited := runs[0].inst.ExitCode(); code != 3 || !exited {
+		t.Error("bad exit code. want: 3 true got:", code, exited)
+	}
+	if _, exited := runs[1].inst.ExitCode(); exited {
+		t.Error("other instance exited")
+	}
+	for _, r := range runs[:2] {
+		if err := r.inst.Close(); err != nil {
+			t.Error(err)
+		}
+		if _, ok := wasi.instances.Load(storeKey(r.store)); ok || r.inst.store != nil {
+			t.Error("closed instance still holds its store")
+		}
+	}
+
+	// every function has a wrapper
+	if err := NewWASI(WithChdir(true)).Define(wasmtime.NewLinker(engine)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_snapshot_preview1" "fd_read" (func $read (param i32 i32 i32 i32) (result i32)))
+		(import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+		(memory (export "memory") 1)
+		(func (export "loop") (loop $l (br $l)))
+		(func (export "read") (result i32)
+			(i32.store (i32.const 0) (i32.const 64))
+			(i32.store (i32.const 4) (i32.const 16))
+			(call $read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+		(func (export "sleep") (param i64) (result i32)
+			;; clock subscription at 100: userdata 7, relative timeout
+			(i64.store (i32.const 100) (i64.const 7))
+			(i32.store8 (i32.const 108) (i32.const 0))
+			(i32.store (i32.const 116) (i32.const 1))
+			(i64.store (i32.const 124) (local.get 0))
+			(drop (call $poll (i32.const 100) (i32.const 200) (i32.const 1) (i32.const 8)))
+			(i32.load (i32.const 8)))
+		(func (export "_start") (loop $l (br $l))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := wasmtime.NewConfig()
+	config.SetEpochInterruption(true)
+	engine := wasmtime.NewEngineWithConfig(config)
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	stdin, stdinw := io.Pipe()
+	defer stdinw.Close()
+	wasi := NewWASI(WithStdin(stdin))
+	if err := wasi.Define(linker); err != nil {
+		t.Fatal(err)
+	}
+	store := wasmtime.NewStore(engine)
+	inst, err := wasi.NewInstance(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	for _, name := range []string{"loop", "read"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := inst.Call(ctx, store, instance.GetFunc(store, name))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error(name, "want:", context.DeadlineExceeded, "got:", err)
+		}
+	}
+	log.SetOutput(os.Stderr)
+	// a cancelled read is a trap, not an errno
+	if logged.Len() > 0 {
+		t.Error("unexpected log output:", logged.String())
+	}
+
+	// the cancelled read's data goes to the next one
+	go stdinw.Write([]byte("hello"))
+	read := instance.GetFunc(store, "read")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if got, err := inst.Call(ctx, store, read); err != nil || got != int32(0) {
+		t.Error("read: want: success got:", got, err)
+	}
+	cancel()
+	mem := instance.GetExport(store, "memory").Memory().UnsafeData(store)
+	if n := binary.LittleEndian.Uint32(mem[8:]); string(mem[64:64+n]) != "hello" {
+		t.Errorf("read: want: %q got: %q", "hello", mem[64:64+n])
+	}
+
+	sleep := instance.GetFunc(store, "sleep")
+	got, err := inst.Call(context.Background(), store, sleep, int64(time.Millisecond))
+	if err != nil || got != int32(1) {
+		t.Error("sleep: want: 1 event got:", got, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := inst.Call(ctx, store, sleep, int64(time.Hour)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("sleep: want:", context.DeadlineExceeded, "got:", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := inst.Run(ctx, store, instance); !errors.Is(err, context.Canceled) {
+		t.Error("run: want:", context.Canceled, "got:", err)
+	}
+
+	// the cancelled read left a goroutine reading stdin, which Close stops
+	if n := readLoops(); n != 1 {
+		t.Fatal("want 1 stdin reader, got:", n)
+	}
+	if err := inst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); readLoops() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stdin reader still running after Close")
+		}
+	}
+}
+
+func TestCallStores(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "loop") (loop $l (br $l))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := wasmtime.NewConfig()
+	config.SetEpochInterruption(true)
+	engine := wasmtime.NewEngineWithConfig(config)
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	wasi := NewWASI()
+	if err := wasi.Define(linker); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling a call in one store leaves the other store's call running
+	timeouts := []time.Duration{50 * time.Millisecond, 500 * time.Millisecond}
+	errs := make([]error, len(timeouts))
+	took := make([]time.Duration, len(timeouts))
+	var wg sync.WaitGroup
+	for i, timeout := range timeouts {
+		store := wasmtime.NewStore(engine)
+		inst, err := wasi.NewInstance(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instance, err := linker.Instantiate(store, module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, timeout time.Duration) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			_, errs[i] = inst.Call(ctx, store, instance.GetFunc(store, "loop"))
+			took[i] = time.Since(start)
+		}(i, timeout)
+	}
+	wg.Wait()
+	for i, timeout := range timeouts {
+		if !errors.Is(errs[i], context.DeadlineExceeded) {
+			t.Error(i, "want:", context.DeadlineExceeded, "got:", errs[i])
+		}
+		if took[i] < timeout {
+			t.Error(i, "stopped early:", took[i])
+		}
+	}
+}
+
+// readLoops counts the goroutines running stream.readLoop.
+func readLoops() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return bytes.Count(buf, []byte("hammertime.(*stream).readLoop("))
+}
+
+func TestSnapshot0(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+		(import "wasi_unstable" "fd_seek" (func $seek (param i32 i64 i32 i32) (result i32)))
+		(import "wasi_unstable" "fd_filestat_get" (func $stat (param i32 i32) (result i32)))
+		(import "wasi_unstable" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+		(memory (export "memory") 1)
+		(func (export "seek") (param i32 i64 i32) (result i64)
+			(drop (call $seek (local.get 0) (local.get 1) (local.get 2) (i32.const 0)))
+			(i64.load (i32.const 0)))
+		;; returns nlink << 32 | size
+		(func (export "stat") (param i32) (result i64)
+			(drop (call $stat (local.get 0) (i32.const 0)))
+			(i64.or
+				(i64.shl (i64.load32_u (i32.const 20)) (i64.const 32))
+				(i64.load (i32.const 24))))
+		;; sleeps 1ns with a clock subscription, returning the event's userdata
+		(func (export "sleep") (result i64)
+			(i64.store (i32.const 100) (i64.const 7))
+			(i32.store8 (i32.const 108) (i32.const 0))
+			(i64.store (i32.const 116) (i64.const 99))
+			(i32.store (i32.const 124) (i32.const 1))
+			(i64.store (i32.const 132) (i64.const 1))
+			(drop (call $poll (i32.const 100) (i32.const 200) (i32.const 1) (i32.const 0)))
+			(i64.load (i32.const 200))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memfs, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hackpadfs.WriteFullFile(memfs, "a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := wasmtime.NewEngine()
+	store := wasmtime.NewStore(engine)
+	module, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linker := wasmtime.NewLinker(engine)
+	wasi := NewWASI(WithFS(memfs))
+	if err := wasi.Link(store, linker); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, errno := wasi.open(rootFD, "a.txt", 0, 0, 0, libc.RightFdRead|libc.RightFdSeek)
+	if errno != 0 {
+		t.Fatal("open", errno)
+	}
+
+	call := func(name string, args ...any) any {
+		t.Helper()
+		got, err := instance.GetFunc(store, name).Call(store, args...)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		return got
+	}
+	if got := call("stat", fd); got != int64(1)<<32|5 {
+		t.Errorf("stat: want nlink 1 size 5, got: %x", got)
+	}
+	for _, tc := range []struct {
+		offset int64
+		whence libc.Whence0
+		want   int64
+	}{
+		{2, libc.Whence0Set, 2},
+		{1, libc.Whence0Cur, 3},
+		{-1, libc.Whence0End, 4},
+	} {
+		if got := call("seek", fd, tc.offset, int32(tc.whence)); got != tc.want {
+			t.Error("seek", tc.offset, tc.whence, "want:", tc.want, "got:", got)
+		}
+	}
+	// 256 isn't Whence0Cur: the seek fails, leaving the last result in place
+	if got := call("seek", fd, int64(1), int32(256)); got != int64(4) {
+		t.Error("seek with bad whence: want: unchanged 4 got:", got)
+	}
+	if got := call("sleep"); got != int64(7) {
+		t.Error("poll: want userdata 7, got:", got)
+	}
+}
+
+func TestCancelBackends(t *testing.T) {
+	// sleepWasm waits in poll_oneoff for longer than this
+	const after = 10 * time.Millisecond
+	backends := map[string]func(ctx context.Context) error{
+		"wasmtime": func(ctx context.Context) error {
+			engine := wasmtime.NewEngine()
+			module, err := wasmtime.NewModule(engine, []byte(sleepWasm))
+			if err != nil {
+				return err
+			}
+			store := wasmtime.NewStore(engine)
+			linker := wasmtime.NewLinker(engine)
+			wasi := NewWASI()
+			if err := wasi.Link(store, linker); err != nil {
+				return err
+			}
+			instance, err := linker.Instantiate(store, module)
+			if err != nil {
+				return err
+			}
+			return wasi.Run(ctx, store, instance)
+		},
+		"wazero": func(ctx context.Context) error {
+			r := wazero.NewRuntime(ctx)
+			defer r.Close(context.Background())
+			if err := NewWASI().InstantiateWazero(ctx, r); err != nil {
+				return err
+			}
+			_, err := r.Instantiate(ctx, []byte(sleepWasm))
+			return err
+		},
+	}
+	for name, run := range backends {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(after, cancel)
+		if err := run(ctx); !errors.Is(err, context.Canceled) {
+			t.Error(name, "want:", context.Canceled, "got:", err)
+		}
+		cancel()
+	}
+}
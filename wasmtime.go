@@ -0,0 +1,217 @@
+//go:build cgo
+
+package hammertime
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/bytecodealliance/wasmtime-go/v11"
+)
+
+// Link defines all (supported) WASI functions on the given linker,
+// and uses the default instance for the given store.
+// The store is kept alive until the default instance is closed with wasi.Close.
+// To run the same WASI in several stores, use Define and NewInstance instead.
+func (wasi *WASI) Link(store wasmtime.Storelike, linker *wasmtime.Linker) error {
+	if wasi.err != nil {
+		return wasi.err
+	}
+	if err := wasi.Define(linker); err != nil {
+		return err
+	}
+	wasi.register(storeKey(store), store, wasi.Instance)
+	return nil
+}
+
+// Define defines all (supported) WASI functions on the given linker, for use with any store.
+// Each store must be given an instance with NewInstance before calling into the guest.
+func (wasi *WASI) Define(linker *wasmtime.Linker) error {
+	for module, symbols := range wasi.modules() {
+		if err := wasi.define(linker, module, symbols); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewInstance creates fresh state for a guest running in the given store, replacing any previous instance for it.
+// Only one instance per store is supported.
+// The functions must already be defined on the store's linker with Define.
+// The instance must be closed when it's done: until then, it keeps the store alive, along with the guest's memory.
+//
+// Options given here apply on top of the WASI's own, for this instance only,
+// such as giving each instance its own stdio or environment.
+// Options that change which functions are defined, like WithChdir, have no effect.
+// It returns an error if the instance can't be set up, such as when its working directory doesn't exist.
+func (wasi *WASI) NewInstance(store wasmtime.Storelike, opts ...Option) (*Instance, error) {
+	inst, err := wasi.newInstance(wasi.override(opts))
+	if err != nil {
+		inst.Close()
+		return nil, err
+	}
+	wasi.register(storeKey(store), store, inst)
+	return inst, nil
+}
+
+// instanceOf returns the instance for the caller's store, or a trap if there isn't one.
+func (wasi *WASI) instanceOf(caller *wasmtime.Caller) (*Instance, *wasmtime.Trap) {
+	inst, ok := wasi.instances.Load(storeKey(caller))
+	if !ok {
+		return nil, wasmtime.NewTrap("hammertime: no WASI instance for this store")
+	}
+	return inst.(*Instance), nil
+}
+
+// storeKey identifies a store. It's the same for a store and callers in it.
+// A freed store's context can be reused by a new store, so registered stores are kept alive until their instance is closed.
+func storeKey(store wasmtime.Storelike) uintptr {
+	return uintptr(unsafe.Pointer(store.Context()))
+}
+
+// define defines functions in module on the linker, given method expressions of Instance.
+// The functions find the instance for the calling store and call the method on it.
+func (wasi *WASI) define(linker *wasmtime.Linker, module string, symbols map[string]any) error {
+	for name, method := range symbols {
+		fn := wasi.bind(method)
+		if fn == nil {
+			return fmt.Errorf("hammertime: %s.%s: unsupported signature %T", module, name, method)
+		}
+		if err := linker.FuncWrap(module, name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bind turns func(*Instance, guest, ...) (..., *trap)
+// into func(*wasmtime.Caller, ...) (..., *wasmtime.Trap).
+// There's a case for each signature used by the WASI functions; it returns nil for any others.
+func (wasi *WASI) bind(method any) any {
+	type (
+		i32 = int32
+		i64 = int64
+	)
+	switch fn := method.(type) {
+	case func(*Instance, guest, i32) *trap:
+		return func(caller *wasmtime.Caller, a i32) *wasmtime.Trap {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return t
+			}
+			return wasmtimeTrap(fn(inst, wasmtimeGuest{caller}, a))
+		}
+	case func(*Instance, guest, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a))
+		}
+	case func(*Instance, guest, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b))
+		}
+	case func(*Instance, guest, i32, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c))
+		}
+	case func(*Instance, guest, i32, i32, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c, d i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d))
+		}
+	case func(*Instance, guest, i32, i32, i32, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c, d, e i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d, e))
+		}
+	case func(*Instance, guest, i32, i32, i32, i32, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c, d, e, f i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d, e, f))
+		}
+	case func(*Instance, guest, i32, i32, i32, i32, i32, i64, i64, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c, d, e i32, f, g i64, h, i i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d, e, f, g, h, i))
+		}
+	case func(*Instance, guest, i32, i32, i32, i64, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a, b, c i32, d i64, e i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d, e))
+		}
+	case func(*Instance, guest, i32, i64, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a i32, b i64, c i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c))
+		}
+	case func(*Instance, guest, i32, i64, i32, i32) (i32, *trap):
+		return func(caller *wasmtime.Caller, a i32, b i64, c, d i32) (i32, *wasmtime.Trap) {
+			inst, t := wasi.instanceOf(caller)
+			if t != nil {
+				return 0, t
+			}
+			return wasmtimeResult(fn(inst, wasmtimeGuest{caller}, a, b, c, d))
+		}
+	}
+	return nil
+}
+func wasmtimeResult(ret int32, t *trap) (int32, *wasmtime.Trap) {
+	return ret, wasmtimeTrap(t)
+}
+
+func wasmtimeTrap(t *trap) *wasmtime.Trap {
+	if t == nil {
+		return nil
+	}
+	return wasmtime.NewTrap(t.msg)
+}
+
+// wasmtimeGuest is a guest calling from wasmtime.
+type wasmtimeGuest struct {
+	caller *wasmtime.Caller
+}
+
+func (g wasmtimeGuest) memory() []byte {
+	export := g.caller.GetExport("memory")
+	if export == nil || export.Memory() == nil {
+		return nil
+	}
+	mem := export.Memory()
+	defer runtime.KeepAlive(mem)
+	return unsafe.Slice((*byte)(mem.Data(g.caller)), mem.DataSize(g.caller))
+}
+
+func (g wasmtimeGuest) context() context.Context {
+	return nil
+}
@@ -0,0 +1,113 @@
+package hammertime
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// InstantiateWazero instantiates the WASI functions as host modules in the given wazero runtime,
+// so that modules instantiated afterwards can import them. It's the wazero equivalent of Define.
+// wazero is written in pure Go, so this works without cgo.
+//
+// Guests use the default instance, unless they are instantiated or called with a context from NewContext.
+// When the guest calls proc_exit, its module is closed and wazero returns a *sys.ExitError.
+// When a call is cancelled while the guest waits in the host, the error wraps ctx.Err().
+func (wasi *WASI) InstantiateWazero(ctx context.Context, r wazero.Runtime) error {
+	if wasi.err != nil {
+		return wasi.err
+	}
+	for module, symbols := range wasi.modules() {
+		builder := r.NewHostModuleBuilder(module)
+		for name, method := range symbols {
+			builder = builder.NewFunctionBuilder().WithFunc(wasi.bindWazero(name, method)).Export(name)
+		}
+		if _, err := builder.Instantiate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewContext creates fresh state for a guest, and returns a context that directs WASI calls made with it there.
+// Use it with wazero to instantiate the guest (which runs _start) or to call its exports.
+// Options apply on top of the WASI's own, as with NewInstance.
+// Close the instance when it's done, to release its resources.
+// It returns an error if the instance can't be set up, as with NewInstance.
+func (wasi *WASI) NewContext(ctx context.Context, opts ...Option) (context.Context, *Instance, error) {
+	inst, err := wasi.newInstance(wasi.override(opts))
+	if err != nil {
+		inst.Close()
+		return nil, nil, err
+	}
+	return context.WithValue(ctx, instanceKey{wasi}, inst), inst, nil
+}
+
+type instanceKey struct {
+	wasi *WASI
+}
+
+// bindWazero turns func(*Instance, guest, ...) (..., *trap)
+// into func(context.Context, api.Module, ...) (...), which panics to trap.
+func (wasi *WASI) bindWazero(name string, method any) any {
+	fn := reflect.ValueOf(method)
+	typ := fn.Type()
+	in := make([]reflect.Type, typ.NumIn())
+	in[0] = reflect.TypeOf((*context.Context)(nil)).Elem()
+	in[1] = reflect.TypeOf((*api.Module)(nil)).Elem()
+	for i := 2; i < len(in); i++ {
+		in[i] = typ.In(i)
+	}
+	out := make([]reflect.Type, typ.NumOut()-1)
+	for i := range out {
+		out[i] = typ.Out(i)
+	}
+	return reflect.MakeFunc(reflect.FuncOf(in, out, false), func(args []reflect.Value) []reflect.Value {
+		ctx := args[0].Interface().(context.Context)
+		inst, ok := ctx.Value(instanceKey{wasi}).(*Instance)
+		if !ok {
+			inst = wasi.Instance
+		}
+		mod := args[1].Interface().(api.Module)
+
+		args[0] = reflect.ValueOf(inst)
+		args[1] = reflect.ValueOf(wazeroGuest{mod: mod, ctx: ctx})
+		ret := fn.Call(args)
+		if name == "proc_exit" {
+			// same as wazero's own WASI: the module can't be used after exiting
+			code := uint32(args[2].Int())
+			_ = mod.CloseWithExitCode(ctx, code)
+			panic(sys.NewExitError(code))
+		}
+		if t := ret[len(ret)-1].Interface().(*trap); t != nil {
+			if err := ctx.Err(); err != nil {
+				// interrupted: wazero wraps what we panic with, so errors.Is(err, ctx.Err()) works like with Instance.Call
+				panic(err)
+			}
+			panic(t)
+		}
+		return ret[:len(ret)-1]
+	}).Interface()
+}
+
+// wazeroGuest is a guest calling from wazero.
+type wazeroGuest struct {
+	mod api.Module
+	ctx context.Context
+}
+
+func (g wazeroGuest) memory() []byte {
+	mem := g.mod.Memory()
+	if mem == nil {
+		return nil
+	}
+	data, _ := mem.Read(0, mem.Size())
+	return data
+}
+
+func (g wazeroGuest) context() context.Context {
+	return g.ctx
+}
@@ -0,0 +1,190 @@
+package hammertime
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// echoWasm echoes up to 64 bytes of stdin to stdout, then exits with code 3:
+//
+//	(module
+//		(import "wasi_snapshot_preview1" "fd_read" (func $read (param i32 i32 i32 i32) (result i32)))
+//		(import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+//		(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//		(memory (export "memory") 1)
+//		(func (export "_start")
+//			(i32.store (i32.const 0) (i32.const 64))
+//			(i32.store (i32.const 4) (i32.const 64))
+//			(drop (call $read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+//			(i32.store (i32.const 4) (i32.load (i32.const 8)))
+//			(drop (call $write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+//			(call $exit (i32.const 3))
+//			unreachable))
+const echoWasm = "\x00asm\x01\x00\x00\x00\x01\x10\x03`\x04\x7f\x7f\x7f\x7f\x01\x7f`\x01\x7f\x00`\x00\x00\x02g\x03\x16wasi_snapshot_preview1\afd_read\x00\x00\x16wasi_snapshot_preview1\bfd_write\x00\x00\x16wasi_snapshot_preview1\tproc_exit\x00\x01\x03\x02\x01\x02\x05\x03\x01\x00\x01\a\x13\x02\x06memory\x02\x00\x06_start\x00\x03\n9\x017\x00A\x00A\xc0\x006\x02\x00A\x04A\xc0\x006\x02\x00A\x00A\x00A\x01A\b\x10\x00\x1aA\x04A\b(\x02\x006\x02\x00A\x01A\x00A\x01A\b\x10\x01\x1aA\x03\x10\x02\x00\v\x00\x1b\x04name\x01\x14\x03\x00\x04read\x01\x05write\x02\x04exit"
+
+// sleepWasm sleeps for 100ms in poll_oneoff, then exits with code 3:
+//
+//	(module
+//		(import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+//		(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+//		(memory (export "memory") 1)
+//		(func (export "_start")
+//			(i64.store (i32.const 0) (i64.const 1))
+//			(i32.store8 (i32.const 8) (i32.const 0))
+//			(i32.store (i32.const 16) (i32.const 1))
+//			(i64.store (i32.const 24) (i64.const 100000000))
+//			(drop (call $poll (i32.const 0) (i32.const 100) (i32.const 1) (i32.const 200)))
+//			(call $exit (i32.const 3))
+//			unreachable))
+const sleepWasm = "\x00asm\x01\x00\x00\x00\x01\x10\x03`\x04\x7f\x7f\x7f\x7f\x01\x7f`\x01\x7f\x00`\x00\x00\x02I\x02\x16wasi_snapshot_preview1\vpoll_oneoff\x00\x00\x16wasi_snapshot_preview1\tproc_exit\x00\x01\x03\x02\x01\x02\x05\x03\x01\x00\x01\a\x13\x02\x06memory\x02\x00\x06_start\x00\x02\n5\x013\x00A\x00B\x017\x03\x00A\bA\x00:\x00\x00A\x10A\x016\x02\x00A\x18B\x80\xc2\xd7/7\x03\x00A\x00A\xe4\x00A\x01A\xc8\x01\x10\x00\x1aA\x03\x10\x01\x00\v\x00\x14\x04name\x01\r\x02\x00\x04poll\x01\x04exit"
+
+func TestWazero(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	wasi := NewWASI()
+	if err := wasi.InstantiateWazero(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := r.CompileModule(ctx, []byte(echoWasm))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		input := fmt.Sprintf("guest %d", i)
+		stdout := new(bytes.Buffer)
+		ctx, inst, err := wasi.NewContext(ctx, WithStdin(strings.NewReader(input)), WithStdout(stdout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(input))
+		var exit *sys.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != 3 {
+			t.Error("want exit code 3, got:", err)
+		}
+		if code, exited := inst.ExitCode(); code != 3 || !exited {
+			t.Error("bad exit code. want: 3 true got:", code, exited)
+		}
+		if got := stdout.String(); got != input {
+			t.Error("bad stdout. want:", input, "got:", got)
+		}
+		if err := inst.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// without NewContext, guests share the default instance
+	compiled, err = r.CompileModule(ctx, []byte(sleepWasm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("default %d", i)
+			_, err := r.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(name))
+			var exit *sys.ExitError
+			if !errors.As(err, &exit) || exit.ExitCode() != 3 {
+				t.Error("want exit code 3, got:", err)
+			}
+			if r.Module(name) != nil {
+				t.Error("module not closed after exit:", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// each call's context interrupts it, default instance or not
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.InstantiateModule(timeout, compiled, wazero.NewModuleConfig()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("want:", context.DeadlineExceeded, "got:", err)
+	}
+}
+
+func TestBindWazero(t *testing.T) {
+	ctx := context.Background()
+	wasi := NewWASI(WithChdir(true))
+	for module, symbols := range wasi.modules() {
+		for name, method := range symbols {
+			name, method := name, method
+			t.Run(module+"."+name, func(t *testing.T) {
+				defer func() {
+					if v := recover(); v != nil {
+						t.Fatal("panic:", v)
+					}
+				}()
+				r := wazero.NewRuntime(ctx)
+				defer r.Close(ctx)
+				host, err := r.NewHostModuleBuilder(module).
+					NewFunctionBuilder().WithFunc(wasi.bindWazero(name, method)).Export(name).
+					Instantiate(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// call it with all zeros from a guest: the point is that the arguments and results make it through
+				def := host.ExportedFunction(name).Definition()
+				_, err = r.Instantiate(ctx, callerWasm(module, name, def.ParamTypes(), def.ResultTypes()))
+				var exit *sys.ExitError
+				if err != nil && !errors.As(err, &exit) {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// callerWasm returns a module whose _start calls the given import with zeros, dropping its results.
+func callerWasm(module, name string, params, results []api.ValueType) []byte {
+	vec := func(n int, items ...[]byte) []byte {
+		b := binary.AppendUvarint(nil, uint64(n))
+		for _, item := range items {
+			b = append(b, item...)
+		}
+		return b
+	}
+	str := func(s string) []byte { return vec(len(s), []byte(s)) }
+	section := func(id byte, items ...[]byte) []byte {
+		body := vec(len(items), items...)
+		return append(binary.AppendUvarint([]byte{id}, uint64(len(body))), body...)
+	}
+	var code []byte
+	for _, p := range params {
+		if p == api.ValueTypeI64 {
+			code = append(code, 0x42, 0) // i64.const 0
+		} else {
+			code = append(code, 0x41, 0) // i32.const 0
+		}
+	}
+	code = append(code, 0x10, 0) // call 0
+	for range results {
+		code = append(code, 0x1a) // drop
+	}
+	code = append([]byte{0}, append(code, 0x0b)...) // no locals ... end
+
+	wasm := []byte("\x00asm\x01\x00\x00\x00")
+	wasm = append(wasm, section(1,
+		append(append([]byte{0x60}, vec(len(params), params)...), vec(len(results), results)...),
+		[]byte{0x60, 0, 0})...)
+	wasm = append(wasm, section(2, append(append(str(module), str(name)...), 0, 0))...)
+	wasm = append(wasm, section(3, []byte{1})...)
+	wasm = append(wasm, section(5, []byte{0, 1})...)
+	wasm = append(wasm, section(7, append(str("_start"), 0, 1))...)
+	wasm = append(wasm, section(10, vec(len(code), code))...)
+	return wasm
+}
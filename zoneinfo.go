@@ -0,0 +1,84 @@
+package hammertime
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// zoneinfoPath is where the time zone database is mounted.
+const zoneinfoPath = "/usr/share/zoneinfo"
+
+// WithZoneinfo mounts the time zone database tzdata (such as zoneinfo.FS) read-only at /usr/share/zoneinfo,
+// and sets the TZ environment variable to the time zone of the Clock, unless set by WithEnv.
+func WithZoneinfo(tzdata fs.FS) Option {
+	return func(wasi *WASI) {
+		wasi.zoneinfo = tzdata
+		wasi.mounts = append(wasi.mounts, mountpoint{path: zoneinfoPath, fs: readOnly{tzdata}})
+	}
+}
+
+// readOnly hides any write extensions of an fs.FS.
+type readOnly struct {
+	fs.FS
+}
+
+// tzenv returns the TZ environment variable for the given clock.
+// It's the name of the clock's time zone if it can be found in tzdata,
+// or else a POSIX TZ string with the current offset.
+func tzenv(clock Clock, tzdata fs.FS) string {
+	now := clock.Now()
+	name := now.Location().String()
+	if name == "Local" {
+		name = localZoneName()
+	}
+	if name == "UTC" {
+		return name
+	}
+	if fs.ValidPath(name) && name != "." {
+		if info, err := fs.Stat(tzdata, name); err == nil && info.Mode().IsRegular() {
+			return name
+		}
+	}
+
+	abbr, offset := now.Zone()
+	if abbr == "" {
+		abbr = now.Format("-0700")
+	}
+	// POSIX offsets are west of UTC
+	sign := "-"
+	if offset < 0 {
+		sign = "+"
+		offset = -offset
+	}
+	h, m, s := offset/3600, offset/60%60, offset%60
+	std := fmt.Sprintf("%s%d", sign, h)
+	if m != 0 || s != 0 {
+		std += fmt.Sprintf(":%02d", m)
+	}
+	if s != 0 {
+		std += fmt.Sprintf(":%02d", s)
+	}
+	return fmt.Sprintf("<%s>%s", abbr, std)
+}
+
+// localZoneName tries to figure out the name of the host's local time zone.
+func localZoneName() string {
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		tz = strings.TrimPrefix(tz, ":")
+		if tz == "" {
+			return "UTC"
+		}
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		target = filepath.ToSlash(target)
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	return time.Local.String()
+}
@@ -0,0 +1,44 @@
+// Package zoneinfo provides Go's time zone database as an fs.FS,
+// laid out like /usr/share/zoneinfo. It's the same data as the time/tzdata package.
+//
+// Importing this package adds about 400 KB to the program.
+// Use it with hammertime.WithZoneinfo.
+package zoneinfo
+
+import (
+	"archive/zip"
+	"bytes"
+	_ "embed"
+	"io/fs"
+	"os"
+)
+
+//go:generate sh -c "cp \"$(go env GOROOT)/lib/time/zoneinfo.zip\" zoneinfo.zip"
+
+//go:embed zoneinfo.zip
+var zipdata []byte
+
+// FS is the IANA time zone database embedded in the program, in TZif format.
+var FS fs.FS = open()
+
+func open() fs.FS {
+	zr, err := zip.NewReader(bytes.NewReader(zipdata), int64(len(zipdata)))
+	if err != nil {
+		panic("zoneinfo: " + err.Error())
+	}
+	return zr
+}
+
+// Load returns the time zone database to use: like the time package,
+// the zip file named by the ZONEINFO environment variable overrides the embedded FS.
+func Load() (fs.FS, error) {
+	name := os.Getenv("ZONEINFO")
+	if name == "" {
+		return FS, nil
+	}
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
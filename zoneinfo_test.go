@@ -0,0 +1,59 @@
+package hammertime
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/hammertime/libc"
+	"github.com/guregu/hammertime/zoneinfo"
+)
+
+func TestZoneinfo(t *testing.T) {
+	tzdata, err := zoneinfo.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from the embedded data, so this doesn't depend on the host having tzdata
+	tzif, err := fs.ReadFile(tzdata, "Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokyo, err := time.LoadLocationFromTZData("Asia/Tokyo", tzif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, tokyo)
+	wasi := NewWASI(WithClock(FixedClock(now)), WithZoneinfo(tzdata))
+
+	if !strings.Contains(strings.Join(wasi.environ, "\n"), "TZ=Asia/Tokyo") {
+		t.Error("TZ not set. got:", wasi.environ)
+	}
+	fd, errno := wasi.open(rootFD, "/usr/share/zoneinfo/Asia/Tokyo", libc.LookupflagSymlinkfollow, 0, 0, libc.RightFdRead)
+	if errno != 0 {
+		t.Fatal("open zoneinfo", errno)
+	}
+	f, _ := wasi.get(fd)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "TZif" {
+		t.Error("bad zoneinfo file:", string(magic), err)
+	}
+	wasi.close(fd)
+
+	cases := []struct {
+		loc  *time.Location
+		want string
+	}{
+		{time.UTC, "UTC"},
+		{tokyo, "Asia/Tokyo"},
+		{time.FixedZone("XYZ", -(3*3600 + 30*60)), "<XYZ>+3:30"},
+		{time.FixedZone("", 5*3600+45*60), "<+0545>-5:45"},
+	}
+	for _, tc := range cases {
+		if got := tzenv(FixedClock(now.In(tc.loc)), tzdata); got != tc.want {
+			t.Errorf("tzenv(%v): want: %s got: %s", tc.loc, tc.want, got)
+		}
+	}
+}